@@ -1,12 +1,11 @@
-package main
+package maxspn
 
 import (
-	"bytes"
-	"io/ioutil"
+	"io"
 	"log"
 	"math"
 	"math/big"
-	"strconv"
+	"os"
 )
 
 type ACNode interface{}
@@ -25,49 +24,83 @@ type MulNode []int
 type AddNode []int
 
 func LoadAC(filename string) AC {
-	bs, err := ioutil.ReadFile(filename)
+	file, err := os.Open(filename)
 	if err != nil {
 		log.Fatal(err)
 	}
-	bss := bytes.Split(bs, []byte("\n"))
-	end := len(bss) - 1
-	for string(bss[end]) != "EOF" {
-		end--
+	defer file.Close()
+	ac, err := ReadAC(file)
+	if err != nil {
+		log.Fatalf("%s: %v\n", filename, err)
 	}
+	return ac
+}
 
-	scs := bytes.Split(bss[0][1:len(bss[0])-1], []byte(" "))
-	schema := make([]int, len(scs))
-	for i, s := range scs {
-		schema[i] = parseInt(string(s))
+// ReadAC reads an arithmetic circuit in the Libra .ac format. Nodes must be
+// listed in topological order, children before their parents.
+func ReadAC(r io.Reader) (AC, error) {
+	ms := newModelScanner(r)
+	schema, err := ms.schema()
+	if err != nil {
+		return AC{}, err
 	}
-
-	bss = bss[1:end]
-	nodes := make([]ACNode, len(bss))
-	for i, ln := range bss {
-		bs := bytes.Split(ln, []byte(" "))
-		switch string(bs[0]) {
+	nodes := []ACNode{}
+	for {
+		bs, done, err := ms.next()
+		if err != nil {
+			return AC{}, err
+		}
+		if done {
+			break
+		}
+		if len(bs) == 0 {
+			return AC{}, ms.errorf("empty line")
+		}
+		i := len(nodes)
+		switch bs[0] {
 		case "v":
-			nodes[i] = VarNode{
-				Kth:   parseInt(string(bs[1])),
-				Value: parseInt(string(bs[2])),
+			kth, value, err := ms.variable(bs[1:], schema)
+			if err != nil {
+				return AC{}, err
 			}
+			nodes = append(nodes, VarNode{Kth: kth, Value: value})
 		case "n":
-			nodes[i] = NumNode(parseFloat(string(bs[1])))
-		case "*":
-			mn := make(MulNode, len(bs)-1)
-			for j, v := range bs[1:] {
-				mn[j] = parseInt(string(v))
+			if len(bs) != 2 {
+				return AC{}, ms.errorf("number node needs 1 argument, got %d", len(bs)-1)
 			}
-			nodes[i] = mn
-		case "+":
-			an := make(AddNode, len(bs)-1)
+			v, err := ms.float(bs[1])
+			if err != nil {
+				return AC{}, err
+			}
+			if !(v >= 0) || math.IsInf(v, 1) {
+				return AC{}, ms.errorf("number %v out of range", v)
+			}
+			nodes = append(nodes, NumNode(v))
+		case "*", "+":
+			if len(bs) == 1 {
+				return AC{}, ms.errorf("%s node without children", bs[0])
+			}
+			cs := make([]int, len(bs)-1)
 			for j, v := range bs[1:] {
-				an[j] = parseInt(string(v))
+				c, err := ms.child(v, i)
+				if err != nil {
+					return AC{}, err
+				}
+				cs[j] = c
 			}
-			nodes[i] = an
+			if bs[0] == "*" {
+				nodes = append(nodes, MulNode(cs))
+			} else {
+				nodes = append(nodes, AddNode(cs))
+			}
+		default:
+			return AC{}, ms.errorf("unknown node type %q", bs[0])
 		}
 	}
-	return AC{nodes, schema}
+	if len(nodes) == 0 {
+		return AC{}, ms.errorf("no nodes")
+	}
+	return AC{nodes, schema}, nil
 }
 
 // Return log value
@@ -205,32 +238,10 @@ func (ac AC) MaxMax() []int {
 	return xs
 }
 
+// Derivative returns the log-derivatives of the root of ac at the assignment
+// xs with respect to every node, by Differentiate.
 func (ac AC) Derivative(xs []int) []float64 {
-	pr := ac.Eval(X2Ass(xs, ac.Schema))
-	dr := make([]float64, len(ac.Nodes))
-	for i := range dr {
-		dr[i] = math.Inf(-1)
-	}
-	dr[len(dr)-1] = 0.0
-	for i := len(ac.Nodes) - 1; i >= 0; i-- {
-		switch n := ac.Nodes[i].(type) {
-		case MulNode:
-			for j, ej := range n {
-				other := 0.0
-				for k, ek := range n {
-					if j != k {
-						other += pr[ek]
-					}
-				}
-				dr[ej] = logSumExp(dr[ej], dr[i]+other)
-			}
-		case AddNode:
-			for _, e := range n {
-				dr[e] = logSumExp(dr[e], dr[i])
-			}
-		}
-	}
-	return dr
+	return ac.Flatten().Derivative(X2Ass(xs, ac.Schema))
 }
 
 func X2Ass(xs []int, schema []int) [][]float64 {
@@ -248,7 +259,7 @@ func X2Ass(xs []int, schema []int) [][]float64 {
 	return ass
 }
 
-func logSumExp(as ...float64) float64 {
+func LogSumExp(as ...float64) float64 {
 	return logSumExpF(len(as), func(i int) float64 {
 		return as[i]
 	})
@@ -268,19 +279,3 @@ func logSumExpF(n int, f func(i int) float64) float64 {
 	}
 	return math.Log(sum) + max
 }
-
-func parseInt(s string) int {
-	r, e := strconv.ParseInt(s, 0, 0)
-	if e != nil {
-		log.Fatal(e)
-	}
-	return int(r)
-}
-
-func parseFloat(s string) float64 {
-	r, e := strconv.ParseFloat(s, 64)
-	if e != nil {
-		log.Fatal(e)
-	}
-	return r
-}
@@ -1,8 +1,9 @@
-package main
+package maxspn
 
 import (
 	"math"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -91,3 +92,32 @@ func TestAC_Info(t *testing.T) {
 	//}
 	t.Log(LoadAC("data/idspac/nltcs.ac").Info())
 }
+
+func TestReadAC(t *testing.T) {
+	ac, err := ReadAC(strings.NewReader("(2)\nv 0 0\nv 0 1\nn 0.3\nn 0.7\n* 0 2\n* 1 3\n+ 4 5\nEOF\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := ac.EvalX([]int{1}); math.Abs(p-math.Log(0.7)) > 1e-9 {
+		t.Errorf("EvalX = %f, want %f", p, math.Log(0.7))
+	}
+	bad := []struct {
+		data string
+		line int
+	}{
+		{"(2 x)\nv 0 0\nEOF\n", 1},
+		{"(2)\nv 0 2\nEOF\n", 2},
+		{"(2)\nv 0 0\nn -1\nEOF\n", 3},
+		{"(2)\nv 0 0\nn 1 2\nEOF\n", 3},
+		{"(2)\nv 0 0\n+ 1\nEOF\n", 3},
+		{"(2)\nv 0 0\n*\nEOF\n", 3},
+		{"(2)\nv 0 0\n", 3},
+	}
+	for _, b := range bad {
+		_, err := ReadAC(strings.NewReader(b.data))
+		pe, ok := err.(*ParseError)
+		if !ok || pe.Line != b.line {
+			t.Errorf("ReadAC(%q) = %v, want error at line %d", b.data, err, b.line)
+		}
+	}
+}
@@ -0,0 +1,800 @@
+package maxspn
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// BayesNet is a discrete Bayesian network.
+type BayesNet struct {
+	Names   []string
+	Values  [][]string // state names of every variable
+	Parents [][]int
+	// CPTs[i][c*len(Values[i])+x] is P(X_i = x | the parents of X_i are in
+	// configuration c), where the configurations enumerate the values of
+	// Parents[i] with the last parent varying fastest.
+	CPTs [][]float64
+}
+
+// Schema returns the number of values of every variable.
+func (bn BayesNet) Schema() []int {
+	schema := make([]int, len(bn.Values))
+	for i, vs := range bn.Values {
+		schema[i] = len(vs)
+	}
+	return schema
+}
+
+// config returns the parent configuration of variable i in x.
+func (bn BayesNet) config(i int, x []int) int {
+	c := 0
+	for _, p := range bn.Parents[i] {
+		c = c*len(bn.Values[p]) + x[p]
+	}
+	return c
+}
+
+// LogJoint returns the log of the joint probability of the complete
+// assignment x, as the sum of the log-entries of the CPTs.
+func (bn BayesNet) LogJoint(x []int) float64 {
+	lp := 0.0
+	for i := range bn.CPTs {
+		lp += math.Log(bn.CPTs[i][bn.config(i, x)*len(bn.Values[i])+x[i]])
+	}
+	return lp
+}
+
+// EliminationOrder returns a greedy elimination order of the variables that
+// eliminates, at every step, the variable with the smallest table over
+// itself and its neighbours in the moral graph.
+func (bn BayesNet) EliminationOrder() []int {
+	n := len(bn.Names)
+	adj := make([]map[int]bool, n)
+	for i := range adj {
+		adj[i] = map[int]bool{}
+	}
+	for i, ps := range bn.Parents {
+		family := append([]int{i}, ps...)
+		for _, a := range family {
+			for _, b := range family {
+				if a != b {
+					adj[a][b] = true
+				}
+			}
+		}
+	}
+	done := make([]bool, n)
+	order := make([]int, 0, n)
+	for len(order) < n {
+		best, bestSize := -1, math.Inf(1)
+		for v := 0; v < n; v++ {
+			if done[v] {
+				continue
+			}
+			size := float64(len(bn.Values[v]))
+			for u := range adj[v] {
+				size *= float64(len(bn.Values[u]))
+			}
+			if size < bestSize {
+				best, bestSize = v, size
+			}
+		}
+		for a := range adj[best] {
+			for b := range adj[best] {
+				if a != b {
+					adj[a][b] = true
+				}
+			}
+			delete(adj[a], best)
+		}
+		done[best] = true
+		order = append(order, best)
+	}
+	return order
+}
+
+// bnFactor is a table of AC nodes over vars, with the last variable varying
+// fastest; an entry of -1 is a zero.
+type bnFactor struct {
+	vars    []int
+	entries []int
+}
+
+// Compile compiles bn into an arithmetic circuit by variable elimination in
+// order, or in EliminationOrder if order is nil. The circuit computes the
+// network polynomial: at an assignment its value is the probability of the
+// evidence. Zero CPT entries are left out of the circuit.
+func (bn BayesNet) Compile(order []int) (AC, error) {
+	if order == nil {
+		order = bn.EliminationOrder()
+	}
+	seen := make([]bool, len(bn.Names))
+	for _, v := range order {
+		if v < 0 || v >= len(seen) || seen[v] {
+			return AC{}, fmt.Errorf("elimination order %v is not a permutation of the %d variables", order, len(seen))
+		}
+		seen[v] = true
+	}
+	if len(order) != len(seen) || len(order) == 0 {
+		return AC{}, fmt.Errorf("elimination order %v is not a permutation of the %d variables", order, len(seen))
+	}
+	schema := bn.Schema()
+	ac := AC{Schema: schema}
+	add := func(n ACNode) int {
+		ac.Nodes = append(ac.Nodes, n)
+		return len(ac.Nodes) - 1
+	}
+
+	factors := make([]bnFactor, len(bn.CPTs))
+	for i, cpt := range bn.CPTs {
+		indicators := make([]int, schema[i])
+		for x := range indicators {
+			indicators[x] = add(VarNode{Kth: i, Value: x})
+		}
+		f := bnFactor{vars: append(append([]int{}, bn.Parents[i]...), i), entries: make([]int, len(cpt))}
+		for k, p := range cpt {
+			f.entries[k] = -1
+			if p > 0 {
+				f.entries[k] = add(MulNode{indicators[k%schema[i]], add(NumNode(p))})
+			}
+		}
+		factors[i] = f
+	}
+
+	for _, v := range order {
+		var in, out []bnFactor
+		for _, f := range factors {
+			if f.has(v) {
+				in = append(in, f)
+			} else {
+				out = append(out, f)
+			}
+		}
+		if len(in) > 0 {
+			out = append(out, sumOut(in, v, schema, add))
+		}
+		factors = out
+	}
+
+	root := make(MulNode, 0, len(factors))
+	for _, f := range factors {
+		if f.entries[0] == -1 {
+			return AC{}, fmt.Errorf("the network has probability zero")
+		}
+		root = append(root, f.entries[0])
+	}
+	if len(root) > 1 {
+		return ac.reachable(add(root)), nil
+	}
+	return ac.reachable(root[0]), nil
+}
+
+// CompileSPN compiles bn into an SPN, as AC2SPN of Compile.
+func (bn BayesNet) CompileSPN(order []int) (SPN, error) {
+	ac, err := bn.Compile(order)
+	if err != nil {
+		return SPN{}, err
+	}
+	return AC2SPN(ac), nil
+}
+
+func (f bnFactor) has(v int) bool {
+	for _, u := range f.vars {
+		if u == v {
+			return true
+		}
+	}
+	return false
+}
+
+// sumOut returns the factor of the product of fs with v summed out, adding
+// its nodes to the circuit by add.
+func sumOut(fs []bnFactor, v int, schema []int, add func(ACNode) int) bnFactor {
+	scope := map[int]bool{}
+	for _, f := range fs {
+		for _, u := range f.vars {
+			if u != v {
+				scope[u] = true
+			}
+		}
+	}
+	res := bnFactor{vars: make([]int, 0, len(scope))}
+	for u := range scope {
+		res.vars = append(res.vars, u)
+	}
+	sort.Ints(res.vars)
+	size := 1
+	for _, u := range res.vars {
+		size *= schema[u]
+	}
+	res.entries = make([]int, size)
+
+	x := make([]int, len(schema))
+	for k := range res.entries {
+		for j, r := len(res.vars)-1, k; j >= 0; j-- {
+			u := res.vars[j]
+			x[u], r = r%schema[u], r/schema[u]
+		}
+		sum := AddNode{}
+		for x[v] = 0; x[v] < schema[v]; x[v]++ {
+			mul := MulNode{}
+			for _, f := range fs {
+				e := f.entries[f.index(x, schema)]
+				if e == -1 {
+					mul = nil
+					break
+				}
+				mul = append(mul, e)
+			}
+			switch len(mul) {
+			case 0:
+			case 1:
+				sum = append(sum, mul[0])
+			default:
+				sum = append(sum, add(mul))
+			}
+		}
+		switch len(sum) {
+		case 0:
+			res.entries[k] = -1
+		case 1:
+			res.entries[k] = sum[0]
+		default:
+			res.entries[k] = add(sum)
+		}
+	}
+	return res
+}
+
+func (f bnFactor) index(x []int, schema []int) int {
+	k := 0
+	for _, u := range f.vars {
+		k = k*schema[u] + x[u]
+	}
+	return k
+}
+
+// reachable returns the subcircuit of ac rooted at node root.
+func (ac AC) reachable(root int) AC {
+	nn := root + 1
+	in := make([]bool, nn)
+	in[root] = true
+	for i := root; i >= 0; i-- {
+		if !in[i] {
+			continue
+		}
+		switch n := ac.Nodes[i].(type) {
+		case MulNode:
+			for _, c := range n {
+				in[c] = true
+			}
+		case AddNode:
+			for _, c := range n {
+				in[c] = true
+			}
+		}
+	}
+	id := make([]int, nn)
+	nodes := make([]ACNode, 0, nn)
+	for i, n := range ac.Nodes[:nn] {
+		if !in[i] {
+			continue
+		}
+		switch n := n.(type) {
+		case MulNode:
+			m := make(MulNode, len(n))
+			for j, c := range n {
+				m[j] = id[c]
+			}
+			nodes = append(nodes, m)
+		case AddNode:
+			a := make(AddNode, len(n))
+			for j, c := range n {
+				a[j] = id[c]
+			}
+			nodes = append(nodes, a)
+		default:
+			nodes = append(nodes, n)
+		}
+		id[i] = len(nodes) - 1
+	}
+	return AC{nodes, ac.Schema}
+}
+
+// bnCPT is a probability block as read, before the names are resolved.
+type bnCPT struct {
+	line    int
+	child   string
+	parents []string
+	table   []float64
+	// childFirst orders table by the value of the child first, then by the
+	// parent configuration; otherwise the child varies fastest.
+	childFirst bool
+	deflt      []float64
+	rows       []bnRow
+}
+
+type bnRow struct {
+	values []string
+	probs  []float64
+}
+
+// ReadBIF reads a Bayesian network in the BIF interchange format. A
+// "table" entry of a probability block lists the distribution of the child
+// given the parents with the child value varying slowest and the last
+// parent fastest, as most BIF repositories do; "default" entries and
+// per-configuration rows are also accepted. Properties are ignored.
+func ReadBIF(r io.Reader) (BayesNet, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return BayesNet{}, err
+	}
+	sc := &bifScanner{data: string(data), line: 1}
+	var names []string
+	var values [][]string
+	var cpts []bnCPT
+	for {
+		tok, err := sc.next()
+		if err != nil {
+			return BayesNet{}, err
+		}
+		switch tok {
+		case "":
+			return resolveBN(names, values, cpts)
+		case "network":
+			if err := sc.skipBlock(); err != nil {
+				return BayesNet{}, err
+			}
+		case "variable":
+			name, vs, err := sc.variable()
+			if err != nil {
+				return BayesNet{}, err
+			}
+			names, values = append(names, name), append(values, vs)
+		case "probability":
+			cpt, err := sc.probability()
+			if err != nil {
+				return BayesNet{}, err
+			}
+			cpts = append(cpts, cpt)
+		default:
+			return BayesNet{}, sc.errorf("unexpected %q", tok)
+		}
+	}
+}
+
+type bifScanner struct {
+	data string
+	pos  int
+	line int
+}
+
+func (sc *bifScanner) errorf(format string, args ...interface{}) error {
+	return &ParseError{sc.line, fmt.Sprintf(format, args...)}
+}
+
+// next returns the next token: a punctuation character, a quoted string
+// without its quotes, or a word. It returns "" at the end of the input.
+func (sc *bifScanner) next() (string, error) {
+	for sc.pos < len(sc.data) {
+		switch c := sc.data[sc.pos]; {
+		case c == '\n':
+			sc.line++
+			sc.pos++
+		case c == ' ' || c == '\t' || c == '\r':
+			sc.pos++
+		case strings.HasPrefix(sc.data[sc.pos:], "//"):
+			for sc.pos < len(sc.data) && sc.data[sc.pos] != '\n' {
+				sc.pos++
+			}
+		case strings.HasPrefix(sc.data[sc.pos:], "/*"):
+			end := strings.Index(sc.data[sc.pos+2:], "*/")
+			if end == -1 {
+				return "", sc.errorf("unterminated comment")
+			}
+			sc.line += strings.Count(sc.data[sc.pos:sc.pos+2+end], "\n")
+			sc.pos += end + 4
+		case c == '"':
+			end := strings.IndexByte(sc.data[sc.pos+1:], '"')
+			if end == -1 {
+				return "", sc.errorf("unterminated string")
+			}
+			tok := sc.data[sc.pos+1 : sc.pos+1+end]
+			sc.line += strings.Count(tok, "\n")
+			sc.pos += end + 2
+			return tok, nil
+		case strings.IndexByte("{}()[];,|", c) != -1:
+			sc.pos++
+			return string(c), nil
+		default:
+			start := sc.pos
+			for sc.pos < len(sc.data) && strings.IndexByte(" \t\r\n{}()[];,|\"", sc.data[sc.pos]) == -1 {
+				sc.pos++
+			}
+			return sc.data[start:sc.pos], nil
+		}
+	}
+	return "", nil
+}
+
+func (sc *bifScanner) expect(want string) error {
+	tok, err := sc.next()
+	if err == nil && tok != want {
+		err = sc.errorf("got %q, want %q", tok, want)
+	}
+	return err
+}
+
+// until returns the tokens before the next end token, without the commas.
+func (sc *bifScanner) until(end string) ([]string, error) {
+	toks := []string{}
+	for {
+		tok, err := sc.next()
+		switch {
+		case err != nil:
+			return nil, err
+		case tok == "":
+			return nil, sc.errorf("missing %q", end)
+		case tok == end:
+			return toks, nil
+		case tok != ",":
+			toks = append(toks, tok)
+		}
+	}
+}
+
+// skipBlock skips the tokens up to the end of the next brace block.
+func (sc *bifScanner) skipBlock() error {
+	depth := 0
+	for {
+		tok, err := sc.next()
+		switch {
+		case err != nil:
+			return err
+		case tok == "":
+			return sc.errorf("unterminated block")
+		case tok == "{":
+			depth++
+		case tok == "}":
+			depth--
+			if depth == 0 {
+				return nil
+			}
+		}
+	}
+}
+
+func (sc *bifScanner) variable() (string, []string, error) {
+	name, err := sc.next()
+	if err != nil {
+		return "", nil, err
+	}
+	if err := sc.expect("{"); err != nil {
+		return "", nil, err
+	}
+	var values []string
+	for {
+		tok, err := sc.next()
+		switch {
+		case err != nil:
+			return "", nil, err
+		case tok == "}":
+			if values == nil {
+				return "", nil, sc.errorf("variable %s has no type", name)
+			}
+			return name, values, nil
+		case tok == "type":
+			head, err := sc.until("{")
+			if err != nil {
+				return "", nil, err
+			}
+			if len(head) != 4 || head[0] != "discrete" || head[1] != "[" || head[3] != "]" {
+				return "", nil, sc.errorf("variable %s: unsupported type %v", name, head)
+			}
+			if values, err = sc.until("}"); err != nil {
+				return "", nil, err
+			}
+			if n, err := strconv.Atoi(head[2]); err != nil || n != len(values) || n == 0 {
+				return "", nil, sc.errorf("variable %s: %s values declared, %d listed", name, head[2], len(values))
+			}
+			if err := sc.expect(";"); err != nil {
+				return "", nil, err
+			}
+		default:
+			if _, err := sc.until(";"); err != nil {
+				return "", nil, err
+			}
+		}
+	}
+}
+
+func (sc *bifScanner) probability() (bnCPT, error) {
+	cpt := bnCPT{line: sc.line, childFirst: true}
+	if err := sc.expect("("); err != nil {
+		return cpt, err
+	}
+	vars, err := sc.until(")")
+	if err != nil {
+		return cpt, err
+	}
+	for _, v := range vars {
+		if v == "|" {
+			continue
+		}
+		if cpt.child == "" {
+			cpt.child = v
+		} else {
+			cpt.parents = append(cpt.parents, v)
+		}
+	}
+	if cpt.child == "" {
+		return cpt, sc.errorf("probability without a variable")
+	}
+	if err := sc.expect("{"); err != nil {
+		return cpt, err
+	}
+	for {
+		tok, err := sc.next()
+		if err != nil {
+			return cpt, err
+		}
+		var toks []string
+		switch tok {
+		case "}":
+			return cpt, nil
+		case "property":
+			_, err = sc.until(";")
+		case "table":
+			toks, err = sc.until(";")
+			cpt.table, err = sc.floats(toks, err)
+		case "default":
+			toks, err = sc.until(";")
+			cpt.deflt, err = sc.floats(toks, err)
+		case "(":
+			var row bnRow
+			if row.values, err = sc.until(")"); err == nil {
+				toks, err = sc.until(";")
+				row.probs, err = sc.floats(toks, err)
+			}
+			cpt.rows = append(cpt.rows, row)
+		default:
+			err = sc.errorf("unexpected %q in probability of %s", tok, cpt.child)
+		}
+		if err != nil {
+			return cpt, err
+		}
+	}
+}
+
+func (sc *bifScanner) floats(toks []string, err error) ([]float64, error) {
+	if err != nil {
+		return nil, err
+	}
+	fs := make([]float64, len(toks))
+	for i, t := range toks {
+		if fs[i], err = strconv.ParseFloat(t, 64); err != nil || fs[i] < 0 {
+			return nil, sc.errorf("bad probability %q", t)
+		}
+	}
+	return fs, nil
+}
+
+// ReadXMLBIF reads a Bayesian network in the XMLBIF format, whose tables
+// list the distribution of the child for every parent configuration in turn.
+func ReadXMLBIF(r io.Reader) (BayesNet, error) {
+	type definition struct {
+		For   string   `xml:"FOR"`
+		Given []string `xml:"GIVEN"`
+		Table string   `xml:"TABLE"`
+	}
+	var doc struct {
+		Network struct {
+			Variables []struct {
+				Name     string   `xml:"NAME"`
+				Outcomes []string `xml:"OUTCOME"`
+			} `xml:"VARIABLE"`
+			Definitions   []definition `xml:"DEFINITION"`
+			Probabilities []definition `xml:"PROBABILITY"`
+		} `xml:"NETWORK"`
+	}
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return BayesNet{}, err
+	}
+	var names []string
+	var values [][]string
+	for _, v := range doc.Network.Variables {
+		vs := make([]string, len(v.Outcomes))
+		for i, o := range v.Outcomes {
+			vs[i] = strings.TrimSpace(o)
+		}
+		names, values = append(names, strings.TrimSpace(v.Name)), append(values, vs)
+	}
+	var cpts []bnCPT
+	for _, d := range append(doc.Network.Definitions, doc.Network.Probabilities...) {
+		cpt := bnCPT{child: strings.TrimSpace(d.For)}
+		for _, g := range d.Given {
+			cpt.parents = append(cpt.parents, strings.TrimSpace(g))
+		}
+		for _, t := range strings.Fields(d.Table) {
+			p, err := strconv.ParseFloat(t, 64)
+			if err != nil || p < 0 {
+				return BayesNet{}, fmt.Errorf("probability of %s: bad probability %q", cpt.child, t)
+			}
+			cpt.table = append(cpt.table, p)
+		}
+		cpts = append(cpts, cpt)
+	}
+	return resolveBN(names, values, cpts)
+}
+
+// resolveBN builds the network of the variables and probability blocks read
+// from a file.
+func resolveBN(names []string, values [][]string, cpts []bnCPT) (BayesNet, error) {
+	bn := BayesNet{
+		Names:   names,
+		Values:  values,
+		Parents: make([][]int, len(names)),
+		CPTs:    make([][]float64, len(names)),
+	}
+	if len(names) == 0 {
+		return bn, fmt.Errorf("network has no variables")
+	}
+	index := map[string]int{}
+	for i, name := range names {
+		if _, ok := index[name]; ok {
+			return bn, fmt.Errorf("variable %s declared twice", name)
+		}
+		index[name] = i
+	}
+	for _, cpt := range cpts {
+		errorf := func(format string, args ...interface{}) error {
+			msg := fmt.Sprintf("probability of %s: ", cpt.child) + fmt.Sprintf(format, args...)
+			if cpt.line > 0 {
+				return &ParseError{cpt.line, msg}
+			}
+			return fmt.Errorf("%s", msg)
+		}
+		i, ok := index[cpt.child]
+		if !ok {
+			return bn, errorf("unknown variable")
+		}
+		if bn.CPTs[i] != nil {
+			return bn, errorf("defined twice")
+		}
+		card, cfgs := len(values[i]), 1
+		for _, name := range cpt.parents {
+			p, ok := index[name]
+			if !ok {
+				return bn, errorf("unknown parent %s", name)
+			}
+			bn.Parents[i] = append(bn.Parents[i], p)
+			cfgs *= len(values[p])
+		}
+		table := make([]float64, cfgs*card)
+		filled := make([]bool, cfgs)
+		if cpt.deflt != nil {
+			if len(cpt.deflt) != card {
+				return bn, errorf("default has %d entries, want %d", len(cpt.deflt), card)
+			}
+			for c := range filled {
+				copy(table[c*card:], cpt.deflt)
+				filled[c] = true
+			}
+		}
+		if cpt.table != nil {
+			if len(cpt.table) != len(table) {
+				return bn, errorf("table has %d entries, want %d", len(cpt.table), len(table))
+			}
+			for k, p := range cpt.table {
+				if cpt.childFirst {
+					table[k%cfgs*card+k/cfgs] = p
+				} else {
+					table[k] = p
+				}
+			}
+			for c := range filled {
+				filled[c] = true
+			}
+		}
+		for _, row := range cpt.rows {
+			if len(row.values) != len(cpt.parents) || len(row.probs) != card {
+				return bn, errorf("row %v has %d values and %d entries, want %d and %d", row.values, len(row.values), len(row.probs), len(cpt.parents), card)
+			}
+			c := 0
+			for j, name := range row.values {
+				p := bn.Parents[i][j]
+				v := indexOf(values[p], name)
+				if v == -1 {
+					return bn, errorf("unknown value %s of %s", name, names[p])
+				}
+				c = c*len(values[p]) + v
+			}
+			copy(table[c*card:], row.probs)
+			filled[c] = true
+		}
+		for c, ok := range filled {
+			if !ok {
+				return bn, errorf("parent configuration %d has no entry", c)
+			}
+		}
+		bn.CPTs[i] = table
+	}
+	for i, cpt := range bn.CPTs {
+		if cpt == nil {
+			return bn, fmt.Errorf("variable %s has no probability", names[i])
+		}
+	}
+	if err := bn.checkAcyclic(); err != nil {
+		return bn, err
+	}
+	return bn, nil
+}
+
+func indexOf(ss []string, s string) int {
+	for i, t := range ss {
+		if t == s {
+			return i
+		}
+	}
+	return -1
+}
+
+func (bn BayesNet) checkAcyclic() error {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(bn.Names))
+	var visit func(i int) error
+	visit = func(i int) error {
+		switch state[i] {
+		case visiting:
+			return fmt.Errorf("cycle through variable %s", bn.Names[i])
+		case visited:
+			return nil
+		}
+		state[i] = visiting
+		for _, p := range bn.Parents[i] {
+			if err := visit(p); err != nil {
+				return err
+			}
+		}
+		state[i] = visited
+		return nil
+	}
+	for i := range bn.Names {
+		if err := visit(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadBIF loads a Bayesian network from a BIF file, or from an XMLBIF file
+// if the name ends with .xml or .xmlbif.
+func LoadBIF(filename string) BayesNet {
+	file, err := os.Open(filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+	read := ReadBIF
+	if strings.HasSuffix(filename, ".xml") || strings.HasSuffix(filename, ".xmlbif") {
+		read = ReadXMLBIF
+	}
+	bn, err := read(bufio.NewReader(file))
+	if err != nil {
+		log.Fatalf("%s: %v\n", filename, err)
+	}
+	return bn
+}
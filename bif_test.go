@@ -0,0 +1,199 @@
+package maxspn
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testBIF = `// A small network in the three forms of probability entries.
+network "sprinkler" {
+	property author = "test";
+}
+variable Cloudy {
+	type discrete [ 2 ] { "no", "yes" };
+}
+variable Sprinkler {
+	type discrete [ 2 ] { off, on };
+	property position = (1, 2);
+}
+variable Rain {
+	type discrete [ 3 ] { none, light, heavy };
+}
+variable WetGrass {
+	type discrete [ 2 ] { dry, wet };
+}
+probability ( Cloudy ) {
+	table 0.5, 0.5;
+}
+probability ( Sprinkler | Cloudy ) {
+	(no) 0.5, 0.5;
+	(yes) 0.9, 0.1;
+}
+/* The rain table lists the child values slowest. */
+probability ( Rain | Cloudy ) {
+	table 0.7, 0.2, 0.2, 0.3, 0.1, 0.5;
+}
+probability ( WetGrass | Sprinkler, Rain ) {
+	default 0.1, 0.9;
+	(off, none) 1.0, 0.0;
+	(on, heavy) 0.01, 0.99;
+}
+`
+
+const testXMLBIF = `<?xml version="1.0"?>
+<BIF VERSION="0.3">
+<NETWORK>
+<NAME>sprinkler</NAME>
+<VARIABLE TYPE="nature"><NAME>Cloudy</NAME><OUTCOME>no</OUTCOME><OUTCOME>yes</OUTCOME></VARIABLE>
+<VARIABLE TYPE="nature"><NAME>Sprinkler</NAME><OUTCOME>off</OUTCOME><OUTCOME>on</OUTCOME></VARIABLE>
+<VARIABLE TYPE="nature"><NAME>Rain</NAME><OUTCOME>none</OUTCOME><OUTCOME>light</OUTCOME><OUTCOME>heavy</OUTCOME></VARIABLE>
+<VARIABLE TYPE="nature"><NAME>WetGrass</NAME><OUTCOME>dry</OUTCOME><OUTCOME>wet</OUTCOME></VARIABLE>
+<DEFINITION><FOR>Cloudy</FOR><TABLE>0.5 0.5</TABLE></DEFINITION>
+<DEFINITION><FOR>Sprinkler</FOR><GIVEN>Cloudy</GIVEN><TABLE>0.5 0.5 0.9 0.1</TABLE></DEFINITION>
+<DEFINITION><FOR>Rain</FOR><GIVEN>Cloudy</GIVEN><TABLE>0.7 0.2 0.1 0.2 0.3 0.5</TABLE></DEFINITION>
+<DEFINITION><FOR>WetGrass</FOR><GIVEN>Sprinkler</GIVEN><GIVEN>Rain</GIVEN>
+<TABLE>1 0 0.1 0.9 0.1 0.9 0.1 0.9 0.1 0.9 0.01 0.99</TABLE></DEFINITION>
+</NETWORK>
+</BIF>
+`
+
+func TestReadBIF(t *testing.T) {
+	bn, err := ReadBIF(strings.NewReader(testBIF))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := BayesNet{
+		Names:   []string{"Cloudy", "Sprinkler", "Rain", "WetGrass"},
+		Values:  [][]string{{"no", "yes"}, {"off", "on"}, {"none", "light", "heavy"}, {"dry", "wet"}},
+		Parents: [][]int{nil, {0}, {0}, {1, 2}},
+		CPTs: [][]float64{
+			{0.5, 0.5},
+			{0.5, 0.5, 0.9, 0.1},
+			{0.7, 0.2, 0.1, 0.2, 0.3, 0.5},
+			{1, 0, 0.1, 0.9, 0.1, 0.9, 0.1, 0.9, 0.1, 0.9, 0.01, 0.99},
+		},
+	}
+	if !reflect.DeepEqual(bn, want) {
+		t.Errorf("ReadBIF:\n got %+v\nwant %+v", bn, want)
+	}
+	xbn, err := ReadXMLBIF(strings.NewReader(testXMLBIF))
+	if err != nil || !reflect.DeepEqual(xbn, want) {
+		t.Errorf("ReadXMLBIF:\n got %+v, %v\nwant %+v", xbn, err, want)
+	}
+
+	for _, bad := range []string{
+		"variable A { type discrete [ 2 ] { a, b }; }",
+		"variable A { type discrete [ 3 ] { a, b }; } probability ( A ) { table 0.5, 0.5; }",
+		"variable A { type discrete [ 2 ] { a, b }; } probability ( A ) { table 0.5; }",
+		"variable A { type discrete [ 2 ] { a, b }; } probability ( A | B ) { table 0.5, 0.5; }",
+		"variable A { type discrete [ 2 ] { a, b }; } variable B { type discrete [ 2 ] { a, b }; }\n" +
+			"probability ( A | B ) { (a) 0.5, 0.5; } probability ( B ) { table 0.5, 0.5; }",
+		"variable A { type discrete [ 2 ] { a, b }; } probability ( A | A ) { default 0.5, 0.5; }",
+		"variable A { type discrete [ 2 ] { a, b }; } probability ( A ) { table 0.5, x; }",
+	} {
+		if _, err := ReadBIF(strings.NewReader(bad)); err == nil {
+			t.Errorf("ReadBIF(%q) succeeded", bad)
+		}
+	}
+}
+
+// randomBN returns a network over schema whose variables have up to three
+// earlier variables as parents, with some zero CPT entries.
+func randomBN(r *rand.Rand, schema []int) BayesNet {
+	bn := BayesNet{}
+	for i, card := range schema {
+		bn.Names = append(bn.Names, string(rune('A'+i)))
+		values := make([]string, card)
+		for v := range values {
+			values[v] = string(rune('a' + v))
+		}
+		bn.Values = append(bn.Values, values)
+		var ps []int
+		if i > 0 {
+			k := 3
+			if i < k {
+				k = i
+			}
+			ps = append(ps, r.Perm(i)[:r.Intn(k+1)]...)
+		}
+		bn.Parents = append(bn.Parents, ps)
+		cfgs := 1
+		for _, p := range ps {
+			cfgs *= schema[p]
+		}
+		cpt := make([]float64, cfgs*card)
+		for c := 0; c < cfgs; c++ {
+			row := cpt[c*card : (c+1)*card]
+			sum := 0.0
+			for v := range row {
+				if r.Intn(5) > 0 || v == 0 {
+					row[v] = r.Float64() + 0.01
+				}
+				sum += row[v]
+			}
+			for v := range row {
+				row[v] /= sum
+			}
+		}
+		bn.CPTs = append(bn.CPTs, cpt)
+	}
+	return bn
+}
+
+func TestBayesNet_CompileSPN(t *testing.T) {
+	bn, err := ReadBIF(strings.NewReader(testBIF))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, order := range [][]int{nil, {0, 1, 2, 3}, {3, 2, 1, 0}} {
+		spn, err := bn.CompileSPN(order)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rep := spn.Validate(); !rep.Valid() {
+			t.Fatalf("order %v: invalid SPN %+v", order, rep)
+		}
+		for x := 0; x < 24; x++ {
+			xs := []int{x % 2, x / 2 % 2, x / 4 % 3, x / 12}
+			if got, want := spn.EvalX(xs), bn.LogJoint(xs); math.Abs(got-want) > 1e-9 && !(math.IsInf(got, -1) && math.IsInf(want, -1)) {
+				t.Errorf("order %v: EvalX(%v) = %f, want %f", order, xs, got, want)
+			}
+		}
+	}
+
+	r := rand.New(rand.NewSource(1))
+	schema := make([]int, 24)
+	for i := range schema {
+		schema[i] = 2 + r.Intn(2)
+	}
+	bn = randomBN(r, schema)
+	spn, err := bn.CompileSPN(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep := spn.Validate(); !rep.Valid() {
+		t.Fatalf("invalid SPN %+v", rep)
+	}
+	free := make([]int, len(schema))
+	for i := range free {
+		free[i] = -1
+	}
+	if p := spn.EvalX(free); math.Abs(p) > 1e-9 {
+		t.Errorf("total probability %f, want 0", p)
+	}
+	for times := 0; times < 200; times++ {
+		x := make([]int, len(schema))
+		for i := range x {
+			x[i] = r.Intn(schema[i])
+		}
+		if got, want := spn.EvalX(x), bn.LogJoint(x); math.Abs(got-want) > 1e-9 && !(math.IsInf(got, -1) && math.IsInf(want, -1)) {
+			t.Errorf("EvalX(%v) = %f, want %f", x, got, want)
+		}
+	}
+	if _, err := bn.Compile([]int{0, 1}); err == nil {
+		t.Error("Compile with a partial order succeeded")
+	}
+}
@@ -0,0 +1,69 @@
+package maxspn
+
+import (
+	"math"
+	"math/big"
+)
+
+// BigPrec is the mantissa precision, in bits, of EvalXBig.
+const BigPrec = 256
+
+// EvalXBig returns the value, not its log, of the assignment x, in which
+// x[i] == -1 leaves variable i free. It computes in linear space with
+// prec-bit mantissas and exponents of 32 bits, so that neither rounding in
+// the log-sum-exps nor underflow decides ties between close assignments. The
+// log-weights are converted exactly to within their own float64 precision.
+func (f *Flat) EvalXBig(x []int, prec uint) *big.Float {
+	val := make([]*big.Float, f.Len())
+	for i, kind := range f.Kind {
+		v := new(big.Float).SetPrec(prec)
+		cs, ws := f.Child[f.Start[i]:f.Start[i+1]], f.Weight[f.Start[i]:f.Start[i+1]]
+		switch kind {
+		case FlatTrm:
+			if k := f.Kth[i]; x[k] == -1 || x[k] == int(f.Value[i]) {
+				v.SetInt64(1)
+			}
+		case FlatNum:
+			v.Set(bigExp(f.Num[i]))
+		case FlatSum:
+			t := new(big.Float).SetPrec(prec)
+			for k, c := range cs {
+				v.Add(v, t.Mul(bigExp(ws[k]), val[c]))
+			}
+		case FlatPrd:
+			v.SetInt64(1)
+			for _, c := range cs {
+				v.Mul(v, val[c])
+			}
+		}
+		val[i] = v
+	}
+	return val[len(val)-1]
+}
+
+// EvalXBig is Flat.EvalXBig with BigPrec bits.
+func (spn SPN) EvalXBig(x []int) *big.Float {
+	return spn.Flatten().EvalXBig(x, BigPrec)
+}
+
+// bigExp returns e^w, which may be far below the smallest float64, as
+// e^r * 2^k with w = r + k*ln 2 and |r| <= ln 2 / 2.
+func bigExp(w float64) *big.Float {
+	if math.IsInf(w, -1) {
+		return new(big.Float)
+	}
+	k := math.Round(w / math.Ln2)
+	m := new(big.Float).SetFloat64(math.Exp(w - k*math.Ln2))
+	return m.SetMantExp(m, int(k))
+}
+
+// BigLog returns the natural log of v >= 0 as a float64, -Inf if v is zero.
+func BigLog(v *big.Float) float64 {
+	if v.Sign() == 0 {
+		return math.Inf(-1)
+	}
+	m := new(big.Float)
+	e := v.MantExp(m)
+	f, _ := m.Float64()
+	return math.Log(f) + float64(e)*math.Ln2
+}
@@ -0,0 +1,59 @@
+package maxspn
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestFlat_EvalXBig(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	schema := []int{2, 3, 2, 4, 2, 2, 3, 2}
+	for times := 0; times < 5; times++ {
+		spn := randomSPN(r, schema)
+		ac, err := randomBN(r, schema).Compile(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range []*Flat{spn.Flatten(), ac.Flatten()} {
+			for k := 0; k < 10; k++ {
+				x := make([]int, len(schema))
+				for i := range x {
+					x[i] = r.Intn(schema[i]+1) - 1
+				}
+				got, want := BigLog(f.EvalXBig(x, BigPrec)), f.EvalX(x)
+				if math.Abs(got-want) > 1e-9*math.Max(1, math.Abs(want)) {
+					t.Errorf("EvalXBig(%v) = e^%v, want e^%v", x, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestFlat_EvalXBigUnderflow(t *testing.T) {
+	// A product of 200 terminals under weights of e^-10, far below the
+	// smallest float64 in linear space.
+	n := 200
+	spn := SPN{Schema: make([]int, n)}
+	prd := &Prd{}
+	for i := 0; i < n; i++ {
+		spn.Schema[i] = 2
+		a, b := &Trm{Kth: i, Value: 0}, &Trm{Kth: i, Value: 1}
+		sum := &Sum{Edges: []SumEdge{{-10, a}, {math.Log1p(-math.Exp(-10)), b}}}
+		spn.Nodes = append(spn.Nodes, a, b, sum)
+		prd.Edges = append(prd.Edges, PrdEdge{sum})
+	}
+	spn.Nodes = append(spn.Nodes, prd)
+	for i, n := range spn.Nodes {
+		n.SetID(i)
+	}
+	x, y := make([]int, n), make([]int, n)
+	y[0] = 1
+	px, py := spn.EvalXBig(x), spn.EvalXBig(y)
+	if px.Sign() == 0 || px.Cmp(py) >= 0 {
+		t.Fatalf("EvalXBig = %v, %v", px, py)
+	}
+	if got, want := BigLog(px), spn.EvalX(x); math.Abs(got-want) > 1e-9*math.Abs(want) {
+		t.Errorf("EvalXBig = e^%v, want e^%v", got, want)
+	}
+}
@@ -0,0 +1,278 @@
+package maxspn
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+)
+
+// The binary SPN format, little-endian throughout:
+//
+//	header  magic "SPNB", version, then the counts of variables, terminals,
+//	        sum nodes, product nodes, sum edges and product edges, and the
+//	        CRC-32 (IEEE) of the body, all uint32
+//	body    schema      [variables]uint32 cardinalities
+//	        kinds       [nodes]uint8, binaryTrm, binarySum or binaryPrd
+//	        terminals   [terminals][2]uint32 variable and value
+//	        degrees     [sums+products]uint32 child counts of the inner nodes
+//	        children    [sum edges+product edges]uint32 child indices
+//	        weights     [sum edges]float64 log-weights
+//
+// Nodes are in topological order, and the arrays list the terminals, the
+// inner nodes, and their edges in node order.
+const (
+	binaryMagic   = "SPNB"
+	binaryVersion = 1
+	binaryHeader  = 4 + 8*4
+
+	binaryTrm = 0
+	binarySum = 1
+	binaryPrd = 2
+)
+
+type binaryCounts struct {
+	vars, trms, sums, prds, sumEdges, prdEdges uint32
+}
+
+func (c binaryCounts) nodes() int {
+	return int(c.trms) + int(c.sums) + int(c.prds)
+}
+
+func (c binaryCounts) inner() int {
+	return int(c.sums) + int(c.prds)
+}
+
+func (c binaryCounts) edges() int {
+	return int(c.sumEdges) + int(c.prdEdges)
+}
+
+func (c binaryCounts) bodySize() int {
+	return 4*int(c.vars) + c.nodes() + 8*int(c.trms) + 4*c.inner() + 4*c.edges() + 8*int(c.sumEdges)
+}
+
+// WriteBinary writes spn in the binary format. The nodes of spn must be in
+// topological order, as for Save.
+func (spn SPN) WriteBinary(w io.Writer) error {
+	c := binaryCounts{vars: uint32(len(spn.Schema))}
+	for _, n := range spn.Nodes {
+		switch n := n.(type) {
+		case *Trm:
+			c.trms++
+		case *Sum:
+			c.sums++
+			c.sumEdges += uint32(len(n.Edges))
+		case *Prd:
+			c.prds++
+			c.prdEdges += uint32(len(n.Edges))
+		}
+	}
+	le := binary.LittleEndian
+	body := make([]byte, 0, c.bodySize())
+	for _, card := range spn.Schema {
+		body = le.AppendUint32(body, uint32(card))
+	}
+	for _, n := range spn.Nodes {
+		switch n.(type) {
+		case *Trm:
+			body = append(body, binaryTrm)
+		case *Sum:
+			body = append(body, binarySum)
+		case *Prd:
+			body = append(body, binaryPrd)
+		}
+	}
+	for _, n := range spn.Nodes {
+		if n, ok := n.(*Trm); ok {
+			body = le.AppendUint32(body, uint32(n.Kth))
+			body = le.AppendUint32(body, uint32(n.Value))
+		}
+	}
+	for _, n := range spn.Nodes {
+		switch n := n.(type) {
+		case *Sum:
+			body = le.AppendUint32(body, uint32(len(n.Edges)))
+		case *Prd:
+			body = le.AppendUint32(body, uint32(len(n.Edges)))
+		}
+	}
+	for _, n := range spn.Nodes {
+		switch n := n.(type) {
+		case *Sum:
+			for _, e := range n.Edges {
+				body = le.AppendUint32(body, uint32(e.Node.ID()))
+			}
+		case *Prd:
+			for _, e := range n.Edges {
+				body = le.AppendUint32(body, uint32(e.Node.ID()))
+			}
+		}
+	}
+	for _, n := range spn.Nodes {
+		if n, ok := n.(*Sum); ok {
+			for _, e := range n.Edges {
+				body = le.AppendUint64(body, math.Float64bits(e.Weight))
+			}
+		}
+	}
+
+	header := make([]byte, 0, binaryHeader)
+	header = append(header, binaryMagic...)
+	for _, v := range []uint32{binaryVersion, c.vars, c.trms, c.sums, c.prds, c.sumEdges, c.prdEdges, crc32.ChecksumIEEE(body)} {
+		header = le.AppendUint32(header, v)
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+// ReadBinary reads an SPN in the format written by WriteBinary.
+func ReadBinary(r io.Reader) (SPN, error) {
+	le := binary.LittleEndian
+	header := make([]byte, binaryHeader)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return SPN{}, fmt.Errorf("binary SPN header: %v", err)
+	}
+	if string(header[:4]) != binaryMagic {
+		return SPN{}, errors.New("not a binary SPN")
+	}
+	h := make([]uint32, 8)
+	for i := range h {
+		h[i] = le.Uint32(header[4+4*i:])
+	}
+	if h[0] != binaryVersion {
+		return SPN{}, fmt.Errorf("binary SPN version %d, want %d", h[0], binaryVersion)
+	}
+	c := binaryCounts{h[1], h[2], h[3], h[4], h[5], h[6]}
+	// The counts are not yet checked, so let the body grow with the input.
+	body, err := ioutil.ReadAll(io.LimitReader(r, int64(c.bodySize())))
+	if err != nil {
+		return SPN{}, fmt.Errorf("binary SPN body: %v", err)
+	}
+	if len(body) != c.bodySize() {
+		return SPN{}, fmt.Errorf("binary SPN body: %d bytes, want %d", len(body), c.bodySize())
+	}
+	if crc32.ChecksumIEEE(body) != h[7] {
+		return SPN{}, errors.New("binary SPN checksum mismatch")
+	}
+	if c.nodes() == 0 {
+		return SPN{}, errors.New("binary SPN has no nodes")
+	}
+
+	schema := make([]int, c.vars)
+	for i := range schema {
+		schema[i] = int(le.Uint32(body))
+		body = body[4:]
+		if schema[i] < 1 {
+			return SPN{}, fmt.Errorf("binary SPN: bad cardinality %d of variable %d", schema[i], i)
+		}
+	}
+	kinds := body[:c.nodes()]
+	body = body[c.nodes():]
+	trms, body := body[:8*int(c.trms)], body[8*int(c.trms):]
+	degrees, body := body[:4*c.inner()], body[4*c.inner():]
+	children, weights := body[:4*c.edges()], body[4*c.edges():]
+
+	nodes := make([]Node, c.nodes())
+	trmCnt := uint32(0)
+	for i, kind := range kinds {
+		if kind == binaryTrm {
+			if trmCnt == c.trms {
+				return SPN{}, errors.New("binary SPN: terminal count mismatch")
+			}
+			kth, value := int(le.Uint32(trms)), int(le.Uint32(trms[4:]))
+			trms = trms[8:]
+			trmCnt++
+			if kth >= len(schema) || value >= schema[kth] {
+				return SPN{}, fmt.Errorf("binary SPN: terminal %d (%d, %d) out of schema range", i, kth, value)
+			}
+			nodes[i] = &Trm{Kth: kth, Value: value, id: i}
+			continue
+		}
+		if kind != binarySum && kind != binaryPrd {
+			return SPN{}, fmt.Errorf("binary SPN: unknown kind %d of node %d", kind, i)
+		}
+		if len(degrees) == 0 {
+			return SPN{}, errors.New("binary SPN: inner node count mismatch")
+		}
+		deg := le.Uint32(degrees)
+		degrees = degrees[4:]
+		if uint64(len(children)) < 4*uint64(deg) {
+			return SPN{}, errors.New("binary SPN: edge count mismatch")
+		}
+		cs := make([]Node, deg)
+		for j := range cs {
+			ci := le.Uint32(children)
+			children = children[4:]
+			if int(ci) >= i {
+				return SPN{}, fmt.Errorf("binary SPN: child %d of node %d is not defined before it", ci, i)
+			}
+			cs[j] = nodes[ci]
+		}
+		if kind == binaryPrd {
+			es := make([]PrdEdge, deg)
+			for j, c := range cs {
+				es[j] = PrdEdge{c}
+			}
+			nodes[i] = &Prd{Edges: es, id: i}
+			continue
+		}
+		if uint64(len(weights)) < 8*uint64(deg) {
+			return SPN{}, errors.New("binary SPN: sum edge count mismatch")
+		}
+		es := make([]SumEdge, deg)
+		for j, c := range cs {
+			w := math.Float64frombits(le.Uint64(weights))
+			weights = weights[8:]
+			if math.IsNaN(w) || math.IsInf(w, 1) {
+				return SPN{}, fmt.Errorf("binary SPN: log weight %v of node %d out of range", w, i)
+			}
+			es[j] = SumEdge{w, c}
+		}
+		nodes[i] = &Sum{Edges: es, id: i}
+	}
+	if trmCnt != c.trms || len(degrees) != 0 || len(children) != 0 || len(weights) != 0 {
+		return SPN{}, errors.New("binary SPN: node counts do not match the body")
+	}
+	return SPN{nodes, schema}, nil
+}
+
+// SaveBinary writes spn to filename in the binary format.
+func (spn SPN) SaveBinary(filename string) {
+	file, err := os.Create(filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w := bufio.NewWriter(file)
+	if err := spn.WriteBinary(w); err != nil {
+		log.Fatalf("%s: %v\n", filename, err)
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatalf("%s: %v\n", filename, err)
+	}
+	if err := file.Close(); err != nil {
+		log.Fatalf("%s: %v\n", filename, err)
+	}
+}
+
+// LoadBinary loads an SPN saved by SaveBinary.
+func LoadBinary(filename string) SPN {
+	file, err := os.Open(filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+	spn, err := ReadBinary(bufio.NewReader(file))
+	if err != nil {
+		log.Fatalf("%s: %v\n", filename, err)
+	}
+	return spn
+}
@@ -0,0 +1,66 @@
+package maxspn
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBinary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maxspn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r := rand.New(rand.NewSource(1))
+	for times := 0; times < 5; times++ {
+		spn := randomSPN(r, []int{2, 3, 2, 4, 2, 5})
+		text := filepath.Join(dir, "a.spn")
+		spn.Save(text)
+		bin := filepath.Join(dir, "a.spnb")
+		LoadSPN(text).SaveBinary(bin)
+		got := LoadBinary(bin)
+		if !reflect.DeepEqual(got, spn) {
+			t.Fatalf("binary round trip changed the network")
+		}
+		text2 := filepath.Join(dir, "b.spn")
+		got.Save(text2)
+		a, _ := ioutil.ReadFile(text)
+		b, _ := ioutil.ReadFile(text2)
+		if !bytes.Equal(a, b) {
+			t.Fatalf("text -> binary -> text is lossy")
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := randomSPN(r, []int{2, 2, 3}).WriteBinary(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	corrupt := func(i int) []byte {
+		d := append([]byte(nil), data...)
+		d[i] ^= 0xff
+		return d
+	}
+	for _, test := range []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"magic", corrupt(0), "not a binary SPN"},
+		{"version", corrupt(4), "version"},
+		{"checksum", corrupt(len(data) - 1), "checksum"},
+		{"truncated", data[:len(data)-3], "body"},
+		{"empty", nil, "header"},
+	} {
+		_, err := ReadBinary(bytes.NewReader(test.data))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.want)
+		}
+	}
+}
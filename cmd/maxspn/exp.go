@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -11,6 +12,8 @@ import (
 	"os/exec"
 	"sync"
 	"time"
+
+	"github.com/meijun/maxspn"
 )
 
 const (
@@ -51,22 +54,22 @@ func init() {
 }
 
 // Given source, generate transformed data.
-func PrepareData() {
+func PrepareData(r *rand.Rand) {
 	for _, name := range DATA_NAMES {
 		// rename original ac file
 		os.Rename(ID_AC+name+".ac", ID_AC+name)
 
 		// id-ac => id-ac-spn => id-ac-spn-ac
 		if _, err := os.Stat(ID_AC_SPN_AC + name); os.IsNotExist(err) {
-			ac := LoadAC(ID_AC + name)
-			spn := AC2SPN(ac)
+			ac := maxspn.LoadAC(ID_AC + name)
+			spn := maxspn.AC2SPN(ac)
 			spn.Save(ID_AC_SPN + name)
 			spn.SaveAsAC(ID_AC_SPN_AC + name)
 		}
 
 		// lr-spn => lr-spn-ac
 		if _, err := os.Stat(LR_SPN_AC + name); os.IsNotExist(err) {
-			spn := LoadSPN(LR_SPN + name)
+			spn := maxspn.LoadSPN(LR_SPN + name)
 			spn.SaveAsAC(LR_SPN_AC + name)
 		}
 
@@ -77,11 +80,11 @@ func PrepareData() {
 			for row := 0; row < 100; row++ {
 				for i := 0; i < varCnt; i++ {
 					var c byte
-					switch rand.Intn(3) {
+					switch r.Intn(3) {
 					case 0: // hidden
 						c = '*'
 					case 1: // evidence
-						c = byte('0' + rand.Intn(2))
+						c = byte('0' + r.Intn(2))
 					case 2: // query
 						c = '?'
 					}
@@ -99,54 +102,54 @@ func PrepareData() {
 	log.Println("[DONE] PrepareData")
 }
 
-func Prb1kMethod(spn SPN) float64 {
-	return PrbKMax(spn, 1000).P
+func Prb1kMethod(spn maxspn.SPN) float64 {
+	return maxspn.PrbKMax(context.Background(), spn, 1000, rand.New(rand.NewSource(*SEED))).P
 }
-func MaxMaxMethod(spn SPN) float64 {
-	return spn.EvalX(MaxMax(spn))
+func MaxMaxMethod(spn maxspn.SPN) float64 {
+	return spn.EvalX(maxspn.MaxMax(spn))
 }
-func SumMaxMethod(spn SPN) float64 {
-	return spn.EvalX(SumMax(spn))
+func SumMaxMethod(spn maxspn.SPN) float64 {
+	return spn.EvalX(maxspn.SumMax(spn))
 }
-func NaiveBayesMethod(spn SPN) float64 {
-	return spn.EvalX(NaiveBayes(spn))
+func NaiveBayesMethod(spn maxspn.SPN) float64 {
+	return spn.EvalX(maxspn.NaiveBayes(context.Background(), spn))
 }
-func ExactMethod(spn SPN) float64 {
-	return Exact(spn, math.Inf(-1))
-	//return Exact(spn, spn.EvalX(MaxMax(spn)))
+func ExactMethod(spn maxspn.SPN) float64 {
+	return maxspn.Exact(context.Background(), spn, math.Inf(-1))
+	//return maxspn.Exact(context.Background(), spn, spn.EvalX(maxspn.MaxMax(spn)))
 }
-func ExactOrderMethod(spn SPN) float64 {
-	return ExactOrder(spn, math.Inf(-1))
-	//return ExactOrder(spn, spn.EvalX(MaxMax(spn)))
+func ExactOrderMethod(spn maxspn.SPN) float64 {
+	return maxspn.ExactOrder(context.Background(), spn, math.Inf(-1))
+	//return maxspn.ExactOrder(context.Background(), spn, spn.EvalX(maxspn.MaxMax(spn)))
 }
-func ExactOrderDerMethod(spn SPN) float64 {
-	return ExactOrderDer(spn, math.Inf(-1))
-	//return ExactOrderDer(spn, spn.EvalX(MaxMax(spn)))
+func ExactOrderDerMethod(spn maxspn.SPN) float64 {
+	return maxspn.ExactOrderDer(context.Background(), spn, math.Inf(-1))
+	//return maxspn.ExactOrderDer(context.Background(), spn, spn.EvalX(maxspn.MaxMax(spn)))
 }
-func Prb1kBSMethod(spn SPN) float64 {
-	return BeamSearch(spn, PrbK(spn, 1000), 31).P
+func Prb1kBSMethod(spn maxspn.SPN) float64 {
+	return maxspn.BeamSearch(context.Background(), spn, maxspn.PrbK(context.Background(), spn, 1000, rand.New(rand.NewSource(*SEED))), 31).P
 }
-func MaxMaxBSMethod(spn SPN) float64 {
-	x := MaxMax(spn)
-	return BeamSearch(spn, []XP{{x, spn.EvalX(x)}}, 31).P
+func MaxMaxBSMethod(spn maxspn.SPN) float64 {
+	x := maxspn.MaxMax(spn)
+	return maxspn.BeamSearch(context.Background(), spn, []maxspn.XP{{X: x, P: spn.EvalX(x)}}, 31).P
 }
-func SumMaxBSMethod(spn SPN) float64 {
-	x := SumMax(spn)
-	return BeamSearch(spn, []XP{{x, spn.EvalX(x)}}, 31).P
+func SumMaxBSMethod(spn maxspn.SPN) float64 {
+	x := maxspn.SumMax(spn)
+	return maxspn.BeamSearch(context.Background(), spn, []maxspn.XP{{X: x, P: spn.EvalX(x)}}, 31).P
 }
-func TopKMaxMaxMethod(spn SPN) float64 {
-	xs := TopKMaxMax(spn, 1000)
-	return MaxXP(EvalXBatch(spn, xs)).P
+func TopKMaxMaxMethod(spn maxspn.SPN) float64 {
+	xs := maxspn.TopKMaxMax(context.Background(), spn, 1000)
+	return maxspn.MaxXP(maxspn.EvalXBatch(spn, xs)).P
 }
-func TopKMaxMaxBSMethod(spn SPN) float64 {
-	xs := TopKMaxMax(spn, 1000)
-	return BeamSearch(spn, EvalXBatch(spn, xs), 31).P
+func TopKMaxMaxBSMethod(spn maxspn.SPN) float64 {
+	xs := maxspn.TopKMaxMax(context.Background(), spn, 1000)
+	return maxspn.BeamSearch(context.Background(), spn, maxspn.EvalXBatch(spn, xs), 31).P
 }
-func MCMethod(spn SPN) float64 {
-	return MC(spn).P
+func MCMethod(spn maxspn.SPN) float64 {
+	return maxspn.MC(context.Background(), spn).P
 }
 
-func Exp(dataSet string, method func(SPN) float64, label string) {
+func Exp(dataSet string, method func(maxspn.SPN) float64, label string) {
 	tic := time.Now()
 	res := make([]float64, len(DATA_NAMES))
 	tim := make([]float64, len(DATA_NAMES))
@@ -159,7 +162,7 @@ func Exp(dataSet string, method func(SPN) float64, label string) {
 		wg.Add(1)
 		i, name := i, name
 		go func() {
-			spn := LoadSPN(dataSet + name)
+			spn := maxspn.LoadSPN(dataSet + name)
 			ticMethod := time.Now()
 			res[i] = method(spn)
 			tim[i] = time.Since(ticMethod).Seconds()
@@ -190,7 +193,7 @@ func printResult1(label string, res []float64) {
 func libraSPNMPE1(dataSet, dataName string) float64 {
 	x := libraMPE1(SPN_AC[dataSet], dataName)
 	if x != nil {
-		spn := LoadSPN(dataSet + dataName)
+		spn := maxspn.LoadSPN(dataSet + dataName)
 		return spn.EvalX(x)
 	} else {
 		return math.Inf(-1)
@@ -235,9 +238,9 @@ func libraMPE1(dataSet, dataName string) []int {
 func ACMaxMaxExp(dataSet string) {
 	ps := make([]float64, len(DATA_NAMES))
 	for i, name := range DATA_NAMES {
-		ac := LoadAC(dataSet + name)
+		ac := maxspn.LoadAC(dataSet + name)
 		x := ac.MaxMax()
-		p := AC2SPN(ac).EvalX(x)
+		p := maxspn.AC2SPN(ac).EvalX(x)
 		log.Println(x, p)
 		ps[i] = p
 	}
@@ -259,17 +262,16 @@ func ExpQuerySPN(dataSet string) {
 			log.Fatalf("Empty query file: %s\n", QUERY+name)
 		}
 		qs = qs[:qCnt]
-		spn := LoadSPN(dataSet + name)
-		for qj, q := range qs {
-			qt := bytes.Split(q, []byte{' '})
-			q = q[:len(qt)]
-			for k := range qt {
-				q[k] = qt[k][0]
+		spn := maxspn.LoadSPN(dataSet + name)
+		for qj, line := range qs {
+			q, err := maxspn.ParseQuery(string(line))
+			if err != nil {
+				log.Fatalf("%s line %d: %v\n", QUERY+name, qj+1, err)
 			}
 			qSPN := spn.QuerySPN(q)
-			mm := qSPN.EvalX(MaxMax(qSPN))
-			sm := qSPN.EvalX(SumMax(qSPN))
-			ex := ExactOrderDer(qSPN, mm)
+			mm := qSPN.EvalX(maxspn.MaxMax(qSPN))
+			sm := qSPN.EvalX(maxspn.SumMax(qSPN))
+			ex := maxspn.ExactOrderDer(context.Background(), qSPN, mm)
 			eq := func(v float64) int {
 				if math.Abs(v-ex) < 1e-6 {
 					return 1
@@ -277,9 +279,9 @@ func ExpQuerySPN(dataSet string) {
 				return 0
 			}
 			if math.Abs(ex-mm) > 1e-6 {
-				t10 := MaxXP(EvalXBatch(qSPN, TopKMaxMax(qSPN, 10))).P
-				t100 := MaxXP(EvalXBatch(qSPN, TopKMaxMax(qSPN, 100))).P
-				t1k := MaxXP(EvalXBatch(qSPN, TopKMaxMax(qSPN, 1000))).P
+				t10 := maxspn.MaxXP(maxspn.EvalXBatch(qSPN, maxspn.TopKMaxMax(context.Background(), qSPN, 10))).P
+				t100 := maxspn.MaxXP(maxspn.EvalXBatch(qSPN, maxspn.TopKMaxMax(context.Background(), qSPN, 100))).P
+				t1k := maxspn.MaxXP(maxspn.EvalXBatch(qSPN, maxspn.TopKMaxMax(context.Background(), qSPN, 1000))).P
 				log.Printf("Found %s line: %d, mm: %f, exact: %f, %d%d%d\n", dataSet+name, qj+1, mm, ex, eq(t10), eq(t100), eq(t1k))
 			}
 			log.Printf("[DONE] %d %d%d\n", qj, eq(mm), eq(sm))
@@ -288,46 +290,41 @@ func ExpQuerySPN(dataSet string) {
 	}
 }
 
-const (
-	QEH_Q = -1
-	QEH_H = -2
-)
-
-func GenMAPQuery() [][][][]int {
-	qehsss := [][][][]int{}
+func GenMAPQuery(r *rand.Rand) [][][]maxspn.Query {
+	qehsss := [][][]maxspn.Query{}
 	for h := 1; h <= 8; h++ {
 		q := 1
 		//e := 10 - q - h
 		//dir := fmt.Sprintf("%s%d%d%d.qeh", DATA_DIR, q, e, h)
 		//os.Mkdir(dir, 0666)
-		qehss := [][][]int{}
+		qehss := [][]maxspn.Query{}
 		for di /*, name*/ := range DATA_NAMES {
 			//data := []byte{}
-			qehs := [][]int{}
+			qehs := []maxspn.Query{}
 			for row := 0; row < 100; row++ {
-				qeh := make([]int, VAR_CNT[di])
+				qeh := make(maxspn.Query, VAR_CNT[di])
 				qc := len(qeh) * q / 10
 				hc := len(qeh) * h / 10
 				for i := range qeh {
 					switch {
 					case i < qc:
-						qeh[i] = QEH_Q
+						qeh[i] = maxspn.QueryVar
 					case i < qc+hc:
-						qeh[i] = QEH_H
+						qeh[i] = maxspn.HiddenVar
 					default: // evidence
-						qeh[i] = rand.Intn(2)
+						qeh[i] = r.Intn(2)
 					}
 				}
-				qeh = shuffle(qeh)
+				qeh = shuffle(qeh, r)
 				qehs = append(qehs, qeh)
 				//for i, v := range qeh {
 				//	if i != 0 {
 				//		data = append(data, ' ')
 				//	}
 				//	switch v {
-				//	case QEH_Q:
+				//	case maxspn.QueryVar:
 				//		data = append(data, '?')
-				//	case QEH_H:
+				//	case maxspn.HiddenVar:
 				//		data = append(data, '*')
 				//	default:
 				//		data = append(data, byte(v + '0'))
@@ -345,19 +342,19 @@ func GenMAPQuery() [][][][]int {
 	}
 	return qehsss
 }
-func shuffle(is []int) []int {
+func shuffle(is []int, r *rand.Rand) []int {
 	rs := make([]int, len(is))
-	for i, v := range rand.Perm(len(is)) {
+	for i, v := range r.Perm(len(is)) {
 		rs[i] = is[v]
 	}
 	return rs
 }
 
 func ExpMAP() {
-	qsss := GenMAPQuery()
+	qsss := GenMAPQuery(rand.New(rand.NewSource(*SEED)))
 	for h := 1; h <= 8; h++ {
 		for ni, name := range DATA_NAMES {
-			spn := LoadSPN(LR_SPN + name)
+			spn := maxspn.LoadSPN(LR_SPN + name)
 			qs := qsss[h-1][ni]
 			cntMC, cntT100 := 0, 0
 			timMC, timT100 := 0., 0.
@@ -367,25 +364,14 @@ func ExpMAP() {
 				q := q
 				wg.Add(1)
 				go func() {
-					qb := make([]byte, len(q))
-					for i, v := range q {
-						switch v {
-						case QEH_Q:
-							qb[i] = '?'
-						case QEH_H:
-							qb[i] = '*'
-						default:
-							qb[i] = byte('0' + v)
-						}
-					}
-					qSPN := spn.QuerySPN(qb)
+					qSPN := spn.QuerySPN(q)
 					tic := time.Now()
-					mc := MC(qSPN).P
+					mc := maxspn.MC(context.Background(), qSPN).P
 					mux.Lock()
 					timMC += time.Since(tic).Seconds()
 					mux.Unlock()
 					tic = time.Now()
-					t100 := MaxXP(EvalXBatch(qSPN, TopKMaxMax(qSPN, 100))).P
+					t100 := maxspn.MaxXP(maxspn.EvalXBatch(qSPN, maxspn.TopKMaxMax(context.Background(), qSPN, 100))).P
 					mux.Lock()
 					timT100 += time.Since(tic).Seconds()
 					if math.Abs(mc-t100) > 1e-6 {
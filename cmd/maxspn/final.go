@@ -0,0 +1,602 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/meijun/maxspn"
+)
+
+var (
+	BT   = flag.Bool("BT", false, "Best Tree method")
+	NG   = flag.Bool("NG", false, "Normalized Greedy method")
+	AMAP = flag.Bool("AMAP", false, "Argmax-Product method")
+
+	BS   = flag.Bool("BS", false, "Beam Search method")
+	BS_B = flag.Int("BS_B", 10, "Beam size in BS method")
+
+	HC = flag.Bool("HC", false, "Hill Climbing method")
+
+	KBT   = flag.Bool("KBT", false, "K-Best Tree method")
+	KBT_K = flag.Int("KBT_K", 100, "K in KBT method")
+
+	MP       = flag.Bool("MP", false, "Marginal Pruning approach")
+	FC       = flag.Bool("FC", false, "Forward Checking approach")
+	ORDERING = flag.Bool("ORDERING", false, "Ordering approach")
+	STAGE    = flag.Bool("STAGE", false, "Stage approach")
+
+	QEH  = flag.String("QEH", "", "MAP query DIR")
+	UAI  = flag.Bool("UAI", false, "Read UAI .evid/.query files from the query DIR and write UAI solution files")
+	DATA = flag.String("DATA", "", "MAP query DATASETS (delimited by ',')")
+
+	SEED        = flag.Int64("SEED", 0, "Random seed of sampling and query generation")
+	TIMEOUT     = flag.Int("TIMEOUT", 600, "Timeout (in seconds)")
+	GROUP_COUNT = flag.Int("GROUP_COUNT", 25, "Group count")
+
+	COLUMN = flag.String("COLUMN", "BT", "Columns (delimited by ',')")
+	TITLE  = flag.String("TITLE", "", "Title")
+
+	WINCNT  = flag.Bool("WINCNT", false, "Summary table")
+	FINISH  = flag.Bool("FINISH", false, "Finish before time limit exceed")
+	TIMEAVG = flag.Bool("TIMEAVG", false, "Average time")
+	RESAVG  = flag.Bool("RESAVG", false, "Average result")
+	RESLSE  = flag.Bool("RESLSE", false, "Log Sum Exp result")
+	BATTLE  = flag.Bool("BATTLE", false, "Battle")
+	EXACT   = flag.Bool("EXACT", false, "Re-score the assignments in high precision to decide the winners of WINCNT and BATTLE")
+)
+
+func FinalExperiment() {
+	if *QEH == "" {
+		return
+	}
+	log.Printf("QEH: %s\n", *QEH)
+	switch {
+	case *BT:
+		mapInference("BT", maxspn.BT())
+	case *NG:
+		mapInference("NG", maxspn.NG())
+	case *AMAP:
+		mapInference("AMAP", maxspn.AMAP())
+	case *BS:
+		mapInference("BS", maxspn.BS(*BS_B, *SEED))
+	case *HC:
+		mapInference("HC", maxspn.HC())
+	case *KBT:
+		mapInference("KBT", maxspn.KBT(*KBT_K))
+	case *MP:
+		mapInference("MP", maxspn.MP())
+	case *FC:
+		mapInference("FC", maxspn.FC())
+	case *ORDERING:
+		mapInference("ORDERING", maxspn.ORDERING())
+	case *STAGE:
+		mapInference("STAGE", maxspn.STAGE())
+
+	case *WINCNT:
+		summary("WINCNT", summaryWINCNT)
+	case *FINISH:
+		summary("FINISH", summaryFINISH)
+	case *TIMEAVG:
+		summary("TIMEAVG", summaryTIMEAVG)
+	case *RESAVG:
+		summary("RESAVG", summaryRESAVG)
+	case *RESLSE:
+		summary("RESLSE", summaryRESLSE)
+	case *BATTLE:
+		summaryBATTLE("BATTLE")
+	}
+}
+
+func mapInference(methodName string, method maxspn.Method) {
+	suffix := ""
+	if *KBT {
+		suffix = fmt.Sprintf("%d", *KBT_K)
+	} else if *BS {
+		suffix = fmt.Sprintf("%d", *BS_B)
+	}
+	path := fmt.Sprintf("%s%s/%s%s/", RESULT_DIR, *QEH, methodName, suffix)
+	if *UAI {
+		if err := os.MkdirAll(path, 0777); err != nil {
+			log.Fatalf("Mkdir %s: %v\n", path, err)
+		}
+	}
+	datasets := DATASETS
+	if *DATA != "" {
+		datasets = strings.Split(*DATA, ",")
+	}
+	for _, dataset := range datasets {
+		mapInferenceDataset(path, dataset, methodName+suffix, method)
+		log.Printf("[DONE]%s %s\n", methodName, dataset)
+	}
+}
+func mapInferenceDataset(path string, dataset string, methodName string, method maxspn.Method) {
+	spn := maxspn.LoadSPN(SPN_DIR + dataset)
+	var qehs []maxspn.Query
+	var vars []int
+	if *UAI {
+		qehs, vars = loadUAI(dataset, spn.Schema)
+	} else {
+		qehs = loadQEH(dataset)
+	}
+	rs := make([]Record, len(qehs))
+	xs := make([][]int, len(qehs))
+	wg := sync.WaitGroup{}
+	for i, q := range qehs {
+		i, q := i, q
+		wg.Add(1)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout())
+			tic := time.Now()
+			r, err := method.Solve(ctx, spn, q)
+			rs[i] = Record{
+				QEH:     *QEH,
+				Dataset: dataset,
+				Query:   i,
+				Method:  methodName,
+				Score:   Float(r.P),
+				X:       r.X,
+				Time:    time.Since(tic).Seconds(),
+				Status:  STATUS_DONE,
+				Upper:   Float(r.Upper),
+				Stats:   r.Stats,
+			}
+			xs[i] = r.X
+			switch {
+			case err != nil:
+				log.Printf("ERROR: %s %s query %d: %v\n", dataset, methodName, i, err)
+				rs[i].Status, rs[i].Err = STATUS_ERROR, err.Error()
+				rs[i].Score, rs[i].Upper = Float(math.NaN()), Float(math.Inf(1))
+			case ctx.Err() != nil:
+				log.Printf("TIMEOUT: %s %s %s %d gap %f", path, dataset, methodName, i, r.Gap())
+				rs[i].Status = STATUS_TIMEOUT
+			case r.Optimal:
+				rs[i].Status = STATUS_OPTIMAL
+			}
+			cancel()
+			wg.Done()
+		}()
+		if (i+1)%*GROUP_COUNT == 0 {
+			wg.Wait()
+		}
+	}
+	wg.Wait()
+	if err := appendRecords(storeFile(*QEH), rs); err != nil {
+		log.Fatal("Write results ", dataset, ": ", err)
+	}
+	if *UAI {
+		writeUAISolution(path, dataset, xs, vars)
+	}
+}
+
+func loadQEH(dataset string) []maxspn.Query {
+	qehPath := fmt.Sprintf("%s%s/%s", QEH_DIR, *QEH, dataset)
+	qeh, err := ioutil.ReadFile(qehPath)
+	if err != nil {
+		log.Fatalf("ReadFile %s: %v\n", qehPath, err)
+	}
+	qeh = bytes.TrimSpace(qeh)
+	lines := bytes.Split(qeh, []byte{'\n'})
+	if len(lines) != QUERY_COUNT {
+		log.Fatal("Query count doesn't match:", len(lines), QUERY_COUNT)
+	}
+	qehs := make([]maxspn.Query, len(lines))
+	for i, line := range lines {
+		if qehs[i], err = maxspn.ParseQuery(string(line)); err != nil {
+			log.Fatalf("%s line %d: %v\n", qehPath, i+1, err)
+		}
+	}
+	return qehs
+}
+
+// loadUAI reads the evidence samples of dataset.evid and, if it exists, the
+// MAP variables of dataset.query. Without a query file the queries are MPE.
+func loadUAI(dataset string, schema []int) ([]maxspn.Query, []int) {
+	prefix := fmt.Sprintf("%s%s/%s", QEH_DIR, *QEH, dataset)
+	var vars []int
+	if file, err := os.Open(prefix + ".query"); err == nil {
+		vars, err = maxspn.ReadUAIQuery(file, schema)
+		file.Close()
+		if err != nil {
+			log.Fatalf("%s.query: %v\n", prefix, err)
+		}
+	}
+	file, err := os.Open(prefix + ".evid")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+	evids, err := maxspn.ReadUAIEvidence(file, schema)
+	if err != nil {
+		log.Fatalf("%s.evid: %v\n", prefix, err)
+	}
+	qs := make([]maxspn.Query, len(evids))
+	for i, evid := range evids {
+		if qs[i], err = maxspn.UAIQuery(evid, vars); err != nil {
+			log.Fatalf("%s.evid sample %d: %v\n", prefix, i, err)
+		}
+	}
+	return qs, vars
+}
+
+func writeUAISolution(path, dataset string, xs [][]int, vars []int) {
+	task := "MPE"
+	if vars != nil {
+		task = "MAP"
+	}
+	if err := os.MkdirAll(path+"uai", 0777); err != nil {
+		log.Fatalf("Mkdir %suai: %v\n", path, err)
+	}
+	filename := fmt.Sprintf("%suai/%s.%s", path, dataset, task)
+	file, err := os.Create(filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+	if err := maxspn.WriteUAISolution(file, task, xs, vars); err != nil {
+		log.Printf("Write solution %s: %v\n", filename, err)
+	}
+}
+
+func timeout() time.Duration {
+	return time.Duration(*TIMEOUT) * time.Second
+}
+
+const (
+	EXPERIMENT_DIR = "experiment/"
+	SPN_DIR        = EXPERIMENT_DIR + "learn.spn/"
+	QEH_DIR        = EXPERIMENT_DIR + "map.qeh/"
+	RESULT_DIR     = EXPERIMENT_DIR + "result.csv/"
+	SUMMARY_DIR    = EXPERIMENT_DIR + "summary.csv/"
+
+	QUERY_COUNT = 1000
+)
+
+var DATASETS = []string{
+	"nltcs", "msnbc", "kdd", "plants", "baudio",
+	"bnetflix", "jester", "accidents", "tretail", "pumsb_star",
+	"dna", "kosarek", "msweb", "book", "tmovie",
+	"cwebkb", "cr52", "c20ng", "bbc", "ad",
+}
+
+func GenerateQEH() {
+	r := rand.New(rand.NewSource(*SEED))
+	for q := 1; q <= 9; q++ {
+		for e := 0; q+e <= 10; e++ {
+			h := 10 - e - q
+			generateQEH(q, e, h, r)
+		}
+	}
+}
+
+func generateQEH(q, e, h int, r *rand.Rand) {
+	dir := fmt.Sprintf("%s%d%d%d/", QEH_DIR, q, e, h)
+	err := os.Mkdir(dir, 0777)
+	if err != nil {
+		log.Fatalf("Mkdir %s error: %v\n", dir, err)
+	}
+	for _, dataset := range DATASETS {
+		log.Printf("Generating %d%d%d %s\n", q, e, h, dataset)
+		spn := maxspn.LoadSPN(SPN_DIR + dataset)
+		generateQEHFile(dir+dataset, spn.Schema, q, e, h, r)
+	}
+}
+
+func generateQEHFile(filename string, schema []int, q, e, h int, r *rand.Rand) {
+	data := []byte{}
+	qq := 1
+	if tmp := len(schema) * q / 10; qq < tmp {
+		qq = tmp
+	}
+	ee := len(schema) * e / 10
+	hh := len(schema) - qq - ee
+	for cntKth := 0; cntKth < QUERY_COUNT; cntKth++ {
+		qeh := generateQEH1(schema, qq, ee, hh, r)
+		data = append(data, qeh.String()...)
+		data = append(data, '\n')
+	}
+	err := ioutil.WriteFile(filename, data, 0777)
+	if err != nil {
+		log.Fatalf("WriteFile %s: %v\n", filename, err)
+	}
+}
+func generateQEH1(schema []int, q int, e int, h int, r *rand.Rand) maxspn.Query {
+	qeh := make(maxspn.Query, len(schema))
+	for i := range schema {
+		switch {
+		case i < q:
+			qeh[i] = maxspn.QueryVar
+		case i < q+h:
+			qeh[i] = maxspn.HiddenVar
+		default:
+			qeh[i] = r.Intn(schema[i])
+		}
+	}
+	qeh2 := make(maxspn.Query, len(qeh))
+	for i, v := range r.Perm(len(qeh)) {
+		qeh2[i] = qeh[v]
+	}
+	return qeh2
+}
+
+type summaryFunc func(resData [][]Record) []string
+
+func summary(title string, sf summaryFunc) {
+	if *TITLE != "" {
+		title = *TITLE
+	}
+	cols := strings.Split(*COLUMN, ",")
+	data := []byte{}
+	data = append(data, []byte(title)...)
+	for _, c := range cols {
+		data = append(data, ',')
+		data = append(data, []byte(c)...)
+	}
+	data = append(data, '\n')
+	store := loadStore()
+	for _, dataset := range DATASETS {
+		rtss := readRecords(store, dataset, cols)
+		data = append(data, []byte(dataset)...)
+		row := sf(rtss)
+		for _, r := range row {
+			data = append(data, ',')
+			data = append(data, []byte(r)...)
+		}
+		data = append(data, '\n')
+	}
+	if err := os.MkdirAll(SUMMARY_DIR+*QEH, 0777); err != nil {
+		log.Fatalf("Mkdir %s%s: %v\n", SUMMARY_DIR, *QEH, err)
+	}
+	if err := ioutil.WriteFile(SUMMARY_DIR+*QEH+"/"+title, data, 0777); err != nil {
+		log.Fatal("WriteFile:", err)
+	}
+}
+
+func loadStore() Store {
+	store, err := readStore(storeFile(*QEH))
+	if err != nil {
+		log.Fatal("Read results: ", err)
+	}
+	return store
+}
+
+// readRecords returns the records of the methods cols on dataset, which must
+// cover the same queries.
+func readRecords(store Store, dataset string, cols []string) [][]Record {
+	rtss := make([][]Record, len(cols))
+	for ri := range rtss {
+		rs, err := store.Records(dataset, cols[ri])
+		if err != nil {
+			log.Fatal(err)
+		}
+		rtss[ri] = rs
+		if ri > 0 && len(rs) != len(rtss[0]) {
+			log.Fatal("Result count is not equal: ", cols[ri], len(rs), cols[0], len(rtss[0]))
+		}
+	}
+	if *EXACT {
+		rescore(dataset, rtss)
+	}
+	return rtss
+}
+
+// rescore sets the exact values of the records of dataset that hold an
+// assignment, evaluating it on the network in high precision.
+func rescore(dataset string, data [][]Record) {
+	f := maxspn.LoadSPN(SPN_DIR + dataset).Flatten()
+	for i := range data {
+		for j := range data[i] {
+			if r := &data[i][j]; r.X != nil && r.Status != STATUS_ERROR {
+				r.exact = f.EvalXBig(r.X, maxspn.BigPrec)
+			}
+		}
+	}
+}
+
+// exactScores reports whether every record with a score on query j of data
+// has been re-scored. The records of a query are compared exactly only then,
+// so that all of their comparisons use the same scale.
+func exactScores(data [][]Record, j int) bool {
+	for i := range data {
+		if r := data[i][j]; !math.IsNaN(float64(r.Score)) && r.exact == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// cmpScore compares the scores of a and b, neither of which is NaN: exactly
+// if exact is set, and otherwise as equal within EPSILON.
+func cmpScore(a, b Record, exact bool) int {
+	if exact {
+		return a.exact.Cmp(b.exact)
+	}
+	x, y := float64(a.Score), float64(b.Score)
+	switch {
+	case floatEqual(x, y):
+		return 0
+	case x < y:
+		return -1
+	}
+	return 1
+}
+
+func summaryWINCNT(resData [][]Record) []string {
+	cnt := make([]int, len(resData))
+	for j := range resData[0] {
+		exact := exactScores(resData, j)
+		best := -1
+		for i := range resData {
+			r := resData[i][j]
+			if math.IsNaN(float64(r.Score)) {
+				continue
+			}
+			if best == -1 {
+				best = i
+				continue
+			}
+			b := resData[best][j]
+			if exact && r.exact.Cmp(b.exact) > 0 || !exact && r.Score > b.Score {
+				best = i
+			}
+		}
+		for i := range resData {
+			r := resData[i][j]
+			if best != -1 && !math.IsNaN(float64(r.Score)) && cmpScore(r, resData[best][j], exact) == 0 {
+				cnt[i]++
+			}
+		}
+	}
+	res := i2s(cnt)
+	return res
+}
+func i2s(cnt []int) []string {
+	res := make([]string, len(cnt))
+	for i := range cnt {
+		res[i] = fmt.Sprint(cnt[i])
+	}
+	return res
+}
+func f2s(cnt []float64) []string {
+	res := make([]string, len(cnt))
+	for i := range cnt {
+		res[i] = fmt.Sprint(cnt[i])
+	}
+	return res
+}
+
+const EPSILON = 1e-6
+
+func floatEqual(x float64, y float64) bool {
+	xsy := x - y
+	if -EPSILON <= xsy && xsy <= EPSILON {
+		return true
+	}
+	if -EPSILON <= x && x <= EPSILON || -EPSILON <= y && y <= EPSILON {
+		return false
+	}
+	rx := xsy / x
+	ry := xsy / y
+	return (-EPSILON <= rx && rx <= EPSILON) || (-EPSILON <= ry && ry <= EPSILON)
+}
+
+func summaryFINISH(data [][]Record) []string {
+	cnt := make([]int, len(data))
+	for i := range data {
+		for j := range data[i] {
+			if data[i][j].finished() {
+				cnt[i]++
+			}
+		}
+	}
+	return i2s(cnt)
+}
+
+func summaryTIMEAVG(data [][]Record) []string {
+	res := make([]float64, len(data))
+	for i := range data {
+		sum := 0.0
+		for j := range data[i] {
+			sum += data[i][j].Time
+		}
+		sum /= float64(len(data[i]))
+		res[i] = sum
+	}
+	return f2s(res)
+}
+
+func summaryRESAVG(data [][]Record) []string {
+	res := make([]float64, len(data))
+	for i := range data {
+		sum := 0.0
+		for j := range data[i] {
+			r := float64(data[i][j].Score)
+			if math.IsNaN(r) {
+				sum = math.NaN()
+				break
+			}
+			sum += r
+		}
+		sum /= float64(len(data[i]))
+		res[i] = sum
+	}
+	return f2s(res)
+}
+
+func summaryRESLSE(data [][]Record) []string {
+	res := make([]float64, len(data))
+	for i := range data {
+		sum := math.Inf(-1)
+		for j := range data[i] {
+			r := float64(data[i][j].Score)
+			if math.IsNaN(r) {
+				sum = math.NaN()
+				break
+			}
+			sum = maxspn.LogSumExp(sum, r)
+		}
+		res[i] = sum
+	}
+	return f2s(res)
+}
+
+func summaryBATTLE(title string) {
+	if *TITLE != "" {
+		title = *TITLE
+	}
+	cols := strings.Split(*COLUMN, ",")
+	data := []byte{}
+	data = append(data, []byte(title)...)
+	for _, c := range cols {
+		data = append(data, ',')
+		data = append(data, []byte(c)...)
+	}
+	data = append(data, '\n')
+	res := make([][]int, len(cols))
+	for i := range res {
+		res[i] = make([]int, len(cols))
+	}
+	store := loadStore()
+	for _, dataset := range DATASETS {
+		battleDataset(res, readRecords(store, dataset, cols))
+	}
+	for i := range res {
+		data = append(data, []byte(cols[i])...)
+		for j := range res[i] {
+			data = append(data, ',')
+			data = append(data, []byte(fmt.Sprint(res[i][j]))...)
+		}
+		data = append(data, '\n')
+	}
+	if err := os.MkdirAll(SUMMARY_DIR+*QEH, 0777); err != nil {
+		log.Fatalf("Mkdir %s%s: %v\n", SUMMARY_DIR, *QEH, err)
+	}
+	if err := ioutil.WriteFile(SUMMARY_DIR+*QEH+"/"+title, data, 0777); err != nil {
+		log.Fatal("WriteFile:", err)
+	}
+}
+func battleDataset(res [][]int, data [][]Record) {
+	for c := range data[0] {
+		exact := exactScores(data, c)
+		for i := range data {
+			for j := range data {
+				ri := data[i][c]
+				rj := data[j][c]
+				pi, pj := float64(ri.Score), float64(rj.Score)
+				if !floatEqual(ri.Time, rj.Time) && ri.finished() && ri.Time < rj.Time &&
+					!math.IsNaN(pi) && (math.IsNaN(pj) || cmpScore(ri, rj, exact) > 0) {
+					res[i][j]++
+				}
+			}
+		}
+	}
+}
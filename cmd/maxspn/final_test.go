@@ -0,0 +1,50 @@
+package main
+
+import (
+	"math"
+	"math/big"
+	"reflect"
+	"testing"
+)
+
+func TestGenerateQEH(t *testing.T) {
+	GenerateQEH()
+}
+
+func TestSummaryWINCNT(t *testing.T) {
+	// Two methods tie within EPSILON on the first query; the third has no
+	// result on the second.
+	data := [][]Record{
+		{{Score: -10, X: []int{0}}, {Score: -3, X: []int{1}}},
+		{{Score: -10 - 1e-9, X: []int{1}}, {Score: -4, X: []int{0}}},
+		{{Score: -12, X: []int{2}}, {Score: Float(math.NaN())}},
+	}
+	if got, want := summaryWINCNT(data), []string{"2", "1", "0"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("WINCNT = %v, want %v", got, want)
+	}
+	// The exact values break the tie.
+	for i, v := range []float64{1e-5, 2e-5, 1e-6} {
+		data[i][0].exact = big.NewFloat(v)
+	}
+	data[0][1].exact, data[1][1].exact = big.NewFloat(0.1), big.NewFloat(0.01)
+	if got, want := summaryWINCNT(data), []string{"1", "1", "0"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("exact WINCNT = %v, want %v", got, want)
+	}
+	res := [][]int{{0, 0, 0}, {0, 0, 0}, {0, 0, 0}}
+	for i := range data {
+		for j := range data[i] {
+			data[i][j].Status = STATUS_DONE
+			data[i][j].Time = float64(i + 1)
+		}
+	}
+	battleDataset(res, data)
+	if want := [][]int{{0, 1, 2}, {0, 0, 2}, {0, 0, 0}}; !reflect.DeepEqual(res, want) {
+		t.Errorf("exact battle = %v, want %v", res, want)
+	}
+	// A query with a record that has not been re-scored compares all of its
+	// records within EPSILON.
+	data[2][0].exact = nil
+	if got, want := summaryWINCNT(data), []string{"2", "1", "0"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("partly exact WINCNT = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+)
+
+func init() {
+	log.SetOutput(os.Stdout)
+	log.SetFlags(log.Lshortfile | log.Ltime)
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt)
+		<-c
+		for _, f := range finally {
+			f()
+		}
+		os.Exit(0)
+	}()
+}
+
+var finally []func()
+
+func main() {
+	flag.Parse()
+	FinalExperiment()
+}
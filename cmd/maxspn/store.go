@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"os"
+	"strconv"
+
+	"github.com/meijun/maxspn"
+)
+
+// The results of a QEH config are stored in RESULT_DIR/<QEH>.jsonl, one JSON
+// Record per line. Runs append to the store; a later record of the same
+// (dataset, query, method) replaces an earlier one.
+
+const (
+	STATUS_OPTIMAL = "optimal" // finished with a proven MAP assignment
+	STATUS_DONE    = "done"    // finished without a proof
+	STATUS_TIMEOUT = "timeout"
+	STATUS_ERROR   = "error"
+)
+
+type Record struct {
+	QEH     string       `json:"qeh"`
+	Dataset string       `json:"dataset"`
+	Query   int          `json:"query"`
+	Method  string       `json:"method"`
+	Score   Float        `json:"score"`
+	X       []int        `json:"x,omitempty"`
+	Time    float64      `json:"time"`
+	Status  string       `json:"status"`
+	Upper   Float        `json:"upper"`
+	Stats   maxspn.Stats `json:"stats"`
+	Err     string       `json:"err,omitempty"`
+
+	exact *big.Float // the value of X in high precision, set by rescore
+}
+
+// finished reports whether the method returned before the timeout.
+func (r Record) finished() bool {
+	return r.Status == STATUS_OPTIMAL || r.Status == STATUS_DONE
+}
+
+// Float is a float64 that encodes the infinities and NaN, which JSON numbers
+// cannot hold, as the strings "+Inf", "-Inf" and "NaN".
+type Float float64
+
+func (f Float) MarshalJSON() ([]byte, error) {
+	v := float64(f)
+	if math.IsInf(v, 0) || math.IsNaN(v) {
+		return []byte(strconv.Quote(strconv.FormatFloat(v, 'f', -1, 64))), nil
+	}
+	return strconv.AppendFloat(nil, v, 'g', -1, 64), nil
+}
+
+func (f *Float) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if len(data) > 0 && data[0] == '"' {
+		var err error
+		if s, err = strconv.Unquote(s); err != nil {
+			return err
+		}
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return err
+	}
+	*f = Float(v)
+	return nil
+}
+
+func storeFile(qeh string) string {
+	return RESULT_DIR + qeh + ".jsonl"
+}
+
+// appendRecords appends rs to the store at filename.
+func appendRecords(filename string, rs []Record) error {
+	data := []byte{}
+	for _, r := range rs {
+		line, err := json.Marshal(r)
+		if err != nil {
+			return fmt.Errorf("%s %s query %d: %v", r.Method, r.Dataset, r.Query, err)
+		}
+		data = append(data, line...)
+		data = append(data, '\n')
+	}
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+type recordKey struct {
+	dataset string
+	method  string
+}
+
+// Store holds the latest records of a results store, indexed by dataset,
+// method and query.
+type Store map[recordKey][]Record
+
+func readStore(filename string) (Store, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	s := Store{}
+	sc := bufio.NewScanner(file)
+	sc.Buffer(nil, 1<<26)
+	for line := 1; sc.Scan(); line++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var r Record
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, line, err)
+		}
+		if r.Query < 0 {
+			return nil, fmt.Errorf("%s:%d: query index %d", filename, line, r.Query)
+		}
+		k := recordKey{r.Dataset, r.Method}
+		for len(s[k]) <= r.Query {
+			s[k] = append(s[k], Record{Query: -1})
+		}
+		s[k][r.Query] = r
+	}
+	return s, sc.Err()
+}
+
+// Records returns the records of method on dataset in query order. It fails
+// if a query has no record.
+func (s Store) Records(dataset, method string) ([]Record, error) {
+	rs := s[recordKey{dataset, method}]
+	if len(rs) == 0 {
+		return nil, fmt.Errorf("no results of %s on %s", method, dataset)
+	}
+	for i, r := range rs {
+		if r.Query != i {
+			return nil, fmt.Errorf("no result of %s on %s query %d", method, dataset, i)
+		}
+	}
+	return rs, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/meijun/maxspn"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "181.jsonl")
+	rs := []Record{
+		{QEH: "181", Dataset: "nltcs", Query: 0, Method: "BT", Score: -3.5, X: []int{0, 1}, Time: 0.25, Status: STATUS_DONE, Upper: Float(math.Inf(1))},
+		{QEH: "181", Dataset: "nltcs", Query: 1, Method: "BT", Score: Float(math.Inf(-1)), Status: STATUS_TIMEOUT, Upper: -1, Stats: maxspn.Stats{Expanded: 3}},
+		{QEH: "181", Dataset: "nltcs", Query: 0, Method: "MP", Score: Float(math.NaN()), Status: STATUS_ERROR, Upper: Float(math.Inf(1)), Err: "bad query"},
+	}
+	if err := appendRecords(filename, rs); err != nil {
+		t.Fatal(err)
+	}
+	rerun := Record{QEH: "181", Dataset: "nltcs", Query: 1, Method: "BT", Score: -2, Status: STATUS_OPTIMAL, Upper: -2}
+	if err := appendRecords(filename, []Record{rerun}); err != nil {
+		t.Fatal(err)
+	}
+	store, err := readStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Records("nltcs", "BT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Record{rs[0], rerun}; !reflect.DeepEqual(got, want) {
+		t.Errorf("BT records: got %+v, want %+v", got, want)
+	}
+	mp, err := store.Records("nltcs", "MP")
+	if err != nil || !math.IsNaN(float64(mp[0].Score)) || mp[0].Err != "bad query" || mp[0].finished() {
+		t.Errorf("MP records: %+v, %v", mp, err)
+	}
+	if _, err := store.Records("nltcs", "FC"); err == nil {
+		t.Error("records of a missing method")
+	}
+
+	gap := Record{QEH: "181", Dataset: "msnbc", Query: 1, Method: "BT", Upper: 0}
+	if err := appendRecords(filename, []Record{gap}); err != nil {
+		t.Fatal(err)
+	}
+	if store, err = readStore(filename); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Records("msnbc", "BT"); err == nil {
+		t.Error("records with a missing query")
+	}
+}
+
+func TestReadRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "181.jsonl")
+	rs := []Record{
+		{QEH: "181", Dataset: "nltcs", Query: 0, Method: "BT", Score: -3, Status: STATUS_DONE},
+		{QEH: "181", Dataset: "nltcs", Query: 1, Method: "BT", Score: -5, Status: STATUS_DONE},
+		{QEH: "181", Dataset: "nltcs", Query: 0, Method: "MP", Score: -4, Status: STATUS_DONE},
+		{QEH: "181", Dataset: "nltcs", Query: 1, Method: "MP", Score: -5, Status: STATUS_DONE},
+	}
+	if err := appendRecords(filename, rs); err != nil {
+		t.Fatal(err)
+	}
+	store, err := readStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := readRecords(store, "nltcs", []string{"BT", "MP"})
+	if want := [][]Record{rs[:2], rs[2:]}; !reflect.DeepEqual(data, want) {
+		t.Fatalf("records: got %+v, want %+v", data, want)
+	}
+	if got, want := summaryWINCNT(data), []string{"2", "1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("WINCNT = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,232 @@
+package maxspn
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// WriteGo writes a standalone Go file of package pkg that evaluates spn with
+// straight-line code, one statement per node or edge and no allocation:
+//
+//	const NodeCount = len(spn.Nodes)
+//	var Schema = spn.Schema
+//	func Eval(as [][]float64, val []float64) float64
+//	func Derivative(val, dr []float64)
+//
+// Eval fills val as SPN.Eval does and returns the log-value of the root;
+// Derivative fills dr from val as DerivativeS does. Both slices have
+// NodeCount elements and can be reused across calls.
+func (spn SPN) WriteGo(w io.Writer, pkg string) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "// Code generated by maxspn WriteGo. DO NOT EDIT.\n\npackage %s\n\nimport \"math\"\n\n", pkg)
+	fmt.Fprintf(bw, "// NodeCount is the length of the val and dr slices of Eval and Derivative.\nconst NodeCount = %d\n\n", len(spn.Nodes))
+	fmt.Fprintf(bw, "// Schema is the number of values of every variable.\nvar Schema = %s\n\n", goInts(spn.Schema))
+
+	fmt.Fprintln(bw, "// Eval stores in val the log-value of every node at the assignment as and")
+	fmt.Fprintln(bw, "// returns the log-value of the root.")
+	fmt.Fprintln(bw, "func Eval(as [][]float64, val []float64) float64 {")
+	fmt.Fprintf(bw, "\t_ = val[%d]\n", len(spn.Nodes)-1)
+	for i, n := range spn.Nodes {
+		switch n := n.(type) {
+		case *Trm:
+			fmt.Fprintf(bw, "\tval[%d] = math.Log(as[%d][%d])\n", i, n.Kth, n.Value)
+		case *Sum:
+			fmt.Fprintf(bw, "\tval[%d] = logSumExp(", i)
+			for j, e := range n.Edges {
+				if j > 0 {
+					bw.WriteString(", ")
+				}
+				fmt.Fprintf(bw, "%s+val[%d]", goFloat(e.Weight), e.Node.ID())
+			}
+			bw.WriteString(")\n")
+		case *Prd:
+			fmt.Fprintf(bw, "\tval[%d] = 0", i)
+			for _, e := range n.Edges {
+				fmt.Fprintf(bw, " + val[%d]", e.Node.ID())
+			}
+			bw.WriteString("\n")
+		}
+	}
+	fmt.Fprintf(bw, "\treturn val[%d]\n}\n\n", len(spn.Nodes)-1)
+
+	fmt.Fprintln(bw, "// Derivative stores in dr the log-derivative of the root with respect to")
+	fmt.Fprintln(bw, "// every node, given the log-values val of Eval.")
+	fmt.Fprintln(bw, "func Derivative(val, dr []float64) {")
+	fmt.Fprintf(bw, "\t_, _ = val[%d], dr[%d]\n", len(spn.Nodes)-1, len(spn.Nodes)-1)
+	fmt.Fprintln(bw, "\tfor i := range dr[:NodeCount] {\n\t\tdr[i] = math.Inf(-1)\n\t}")
+	fmt.Fprintf(bw, "\tdr[%d] = 0\n", len(spn.Nodes)-1)
+	for i := len(spn.Nodes) - 1; i >= 0; i-- {
+		switch n := spn.Nodes[i].(type) {
+		case *Sum:
+			for _, e := range n.Edges {
+				c := e.Node.ID()
+				fmt.Fprintf(bw, "\tdr[%d] = logSumExp2(dr[%d], dr[%d]+%s)\n", c, c, i, goFloat(e.Weight))
+			}
+		case *Prd:
+			// The product of the siblings of each child, as a running prefix
+			// times a precomputed suffix, so that zero children need no care.
+			k := len(n.Edges)
+			fmt.Fprintf(bw, "\t{\n\t\tvar s [%d]float64\n", k)
+			for j := k - 2; j >= 0; j-- {
+				fmt.Fprintf(bw, "\t\ts[%d] = s[%d] + val[%d]\n", j, j+1, n.Edges[j+1].Node.ID())
+			}
+			bw.WriteString("\t\tp := 0.0\n")
+			for j, e := range n.Edges {
+				c := e.Node.ID()
+				fmt.Fprintf(bw, "\t\tdr[%d] = logSumExp2(dr[%d], dr[%d]+p+s[%d])\n", c, c, i, j)
+				if j < k-1 {
+					fmt.Fprintf(bw, "\t\tp += val[%d]\n", c)
+				}
+			}
+			bw.WriteString("\t}\n")
+		}
+	}
+	bw.WriteString("}\n")
+	bw.WriteString(goLogSumExp)
+	return bw.Flush()
+}
+
+const goLogSumExp = `
+func logSumExp(as ...float64) float64 {
+	max := math.Inf(-1)
+	for _, a := range as {
+		max = math.Max(max, a)
+	}
+	if math.IsInf(max, 0) {
+		return max
+	}
+	sum := 0.0
+	for _, a := range as {
+		sum += math.Exp(a - max)
+	}
+	return math.Log(sum) + max
+}
+
+func logSumExp2(a, b float64) float64 {
+	if a < b {
+		a, b = b, a
+	}
+	if math.IsInf(a, 0) {
+		return a
+	}
+	return a + math.Log1p(math.Exp(b-a))
+}
+`
+
+// WriteGoTest writes a test file for the package of WriteGo that checks Eval
+// and Derivative against the values of SPN.Eval and DerivativeS at every
+// assignment of as.
+func (spn SPN) WriteGoTest(w io.Writer, pkg string, as [][][]float64) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "// Code generated by maxspn WriteGoTest. DO NOT EDIT.\n\npackage %s\n\nimport (\n\t\"math\"\n\t\"testing\"\n)\n\n", pkg)
+	bw.WriteString("var testCases = []struct {\n\tas      [][]float64\n\tval, dr []float64\n}{\n")
+	for _, a := range as {
+		bw.WriteString("\t{\n\t\t[][]float64{")
+		for i, vs := range a {
+			if i > 0 {
+				bw.WriteString(", ")
+			}
+			bw.WriteString(goFloats(vs))
+		}
+		fmt.Fprintf(bw, "},\n\t\t%s,\n\t\t%s,\n\t},\n", goFloats(spn.Eval(a)), goFloats(DerivativeS(spn, a)))
+	}
+	bw.WriteString("}\n")
+	bw.WriteString(goTest)
+	return bw.Flush()
+}
+
+const goTest = `
+func TestGenerated(t *testing.T) {
+	val := make([]float64, NodeCount)
+	dr := make([]float64, NodeCount)
+	for i, c := range testCases {
+		if got, want := Eval(c.as, val), c.val[NodeCount-1]; !near(got, want) {
+			t.Errorf("case %d: Eval = %v, want %v", i, got, want)
+		}
+		Derivative(val, dr)
+		for j := range val {
+			if !near(val[j], c.val[j]) || !near(dr[j], c.dr[j]) {
+				t.Errorf("case %d node %d: val %v dr %v, want %v %v", i, j, val[j], dr[j], c.val[j], c.dr[j])
+			}
+		}
+	}
+}
+
+func near(a, b float64) bool {
+	return a == b || math.Abs(a-b) <= 1e-9*math.Max(1, math.Abs(b))
+}
+`
+
+// SaveGo writes the file of WriteGo to dir/spn.go and, with n random
+// complete and partial assignments as test cases, the file of WriteGoTest to
+// dir/spn_test.go.
+func (spn SPN) SaveGo(dir, pkg string, n int, r *rand.Rand) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		log.Fatal(err)
+	}
+	as := make([][][]float64, n)
+	for i := range as {
+		x := make([]int, len(spn.Schema))
+		for k := range x {
+			x[k] = r.Intn(spn.Schema[k]+1) - 1
+		}
+		as[i] = X2Ass(x, spn.Schema)
+	}
+	for name, write := range map[string]func(io.Writer) error{
+		"spn.go":      func(w io.Writer) error { return spn.WriteGo(w, pkg) },
+		"spn_test.go": func(w io.Writer) error { return spn.WriteGoTest(w, pkg, as) },
+	} {
+		filename := filepath.Join(dir, name)
+		file, err := os.Create(filename)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := write(file); err != nil {
+			log.Fatalf("%s: %v\n", filename, err)
+		}
+		if err := file.Close(); err != nil {
+			log.Fatalf("%s: %v\n", filename, err)
+		}
+	}
+}
+
+func goFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "math.Inf(1)"
+	case math.IsInf(f, -1):
+		return "math.Inf(-1)"
+	case math.IsNaN(f):
+		return "math.NaN()"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func goFloats(fs []float64) string {
+	data := []byte("[]float64{")
+	for i, f := range fs {
+		if i > 0 {
+			data = append(data, ", "...)
+		}
+		data = append(data, goFloat(f)...)
+	}
+	return string(append(data, '}'))
+}
+
+func goInts(is []int) string {
+	data := []byte("[]int{")
+	for i, v := range is {
+		if i > 0 {
+			data = append(data, ", "...)
+		}
+		data = strconv.AppendInt(data, int64(v), 10)
+	}
+	return string(append(data, '}'))
+}
@@ -0,0 +1,36 @@
+package maxspn
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestSPN_SaveGo(t *testing.T) {
+	goTool, err := exec.LookPath("go")
+	if testing.Short() || err != nil {
+		t.Skip("needs the go tool")
+	}
+	dir, err := ioutil.TempDir("", "codegen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r := rand.New(rand.NewSource(1))
+	spn := randomSPN(r, []int{2, 3, 2, 4, 2, 2, 3})
+	// Zero-probability inputs exercise the products with zero children.
+	spn = spn.QuerySPN(mustParseQuery("?,?,1,?,*,?,?"))
+	spn.SaveGo(dir, "spngen", 8, r)
+	if err := ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte("module spngen\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(goTool, "test", ".")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GO111MODULE=on", "GOFLAGS=-mod=mod")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go test of generated code: %v\n%s", err, out)
+	}
+}
@@ -0,0 +1,13 @@
+package maxspn
+
+// Data directories used by the tests, relative to the repository root.
+const (
+	DATA_DIR = "data/"
+
+	ID_AC     = DATA_DIR + "id-ac/"
+	ID_AC_SPN = DATA_DIR + "id-ac-spn/"
+
+	LR_SPN = DATA_DIR + "lr-spn/"
+
+	TY_SPN = DATA_DIR + "ty-spn/"
+)
@@ -0,0 +1,150 @@
+package maxspn
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"sort"
+)
+
+// DedupOptions configures DedupWith. The zero options merge only nodes that
+// compute exactly the same values.
+type DedupOptions struct {
+	Sorted  bool    // key sums and products on their children in any order
+	Quantum float64 // key sum weights rounded to multiples of Quantum, if positive
+}
+
+// Dedup returns spn with every set of structurally identical nodes merged
+// into one: terminals of the same state, and sums or products whose
+// children, after merging, and weights are the same in the same order.
+// Weights are compared bit for bit and the order of the children is kept, so
+// a merged node computes exactly the values of the nodes it replaces and Eval
+// results are preserved exactly. Nodes that are no longer reachable from the
+// root, and nil slots, are dropped and the others get compact IDs in their
+// order. It also returns the compression ratio, the nodes and edges of spn
+// per node and edge of the result.
+func (spn SPN) Dedup() (SPN, float64) {
+	return spn.DedupWith(DedupOptions{})
+}
+
+// DedupWith is Dedup keying the nodes canonically as opt asks: on their
+// children sorted by ID, and on weights rounded to multiples of the quantum.
+// Each merged node keeps the edges of the first node of its set, so it may
+// differ from the others in the order of its sum or in the rounded weights,
+// and Eval results then agree only up to rounding.
+func (spn SPN) DedupWith(opt DedupOptions) (SPN, float64) {
+	type edge struct{ node, weight uint64 }
+	nn := len(spn.Nodes)
+	to := make([]int, nn) // the first node identical to node i
+	seen := map[string]int{}
+	key := []byte{}
+	es := []edge{}
+	for i, n := range spn.Nodes {
+		to[i] = i
+		key = key[:0]
+		es = es[:0]
+		switch n := n.(type) {
+		case *Trm:
+			key = append(key, 't')
+			key = binary.LittleEndian.AppendUint64(key, uint64(n.Kth))
+			key = binary.LittleEndian.AppendUint64(key, uint64(n.Value))
+		case *Sum:
+			key = append(key, 's')
+			for _, e := range n.Edges {
+				w := e.Weight
+				if opt.Quantum > 0 {
+					w = math.Round(w / opt.Quantum)
+				}
+				es = append(es, edge{uint64(to[e.Node.ID()]), math.Float64bits(w)})
+			}
+		case *Prd:
+			key = append(key, 'p')
+			for _, e := range n.Edges {
+				es = append(es, edge{node: uint64(to[e.Node.ID()])})
+			}
+		default:
+			continue
+		}
+		if opt.Sorted {
+			sort.Slice(es, func(a, b int) bool {
+				if es[a].node != es[b].node {
+					return es[a].node < es[b].node
+				}
+				return es[a].weight < es[b].weight
+			})
+		}
+		for _, e := range es {
+			key = binary.LittleEndian.AppendUint64(key, e.node)
+			if key[0] == 's' {
+				key = binary.LittleEndian.AppendUint64(key, e.weight)
+			}
+		}
+		if j, ok := seen[string(key)]; ok {
+			to[i] = j
+		} else {
+			seen[string(key)] = i
+		}
+	}
+
+	root := to[nn-1]
+	reach := make([]bool, nn)
+	reach[root] = true
+	for i := root; i >= 0; i-- {
+		if !reach[i] {
+			continue
+		}
+		switch n := spn.Nodes[i].(type) {
+		case *Sum:
+			for _, e := range n.Edges {
+				reach[to[e.Node.ID()]] = true
+			}
+		case *Prd:
+			for _, e := range n.Edges {
+				reach[to[e.Node.ID()]] = true
+			}
+		}
+	}
+	ns := make([]Node, nn)
+	nodes := []Node{}
+	for i := 0; i <= root; i++ {
+		if !reach[i] {
+			continue
+		}
+		switch n := spn.Nodes[i].(type) {
+		case *Trm:
+			ns[i] = &Trm{Kth: n.Kth, Value: n.Value}
+		case *Sum:
+			es := make([]SumEdge, len(n.Edges))
+			for k, e := range n.Edges {
+				es[k] = SumEdge{e.Weight, ns[to[e.Node.ID()]]}
+			}
+			ns[i] = &Sum{Edges: es}
+		case *Prd:
+			es := make([]PrdEdge, len(n.Edges))
+			for k, e := range n.Edges {
+				es[k] = PrdEdge{ns[to[e.Node.ID()]]}
+			}
+			ns[i] = &Prd{Edges: es}
+		}
+		ns[i].SetID(len(nodes))
+		nodes = append(nodes, ns[i])
+	}
+	merged := SPN{nodes, spn.Schema}
+	before, after := spn.Size(), merged.Size()
+	return merged, float64(before.Nodes+before.Edges) / float64(after.Nodes+after.Edges)
+}
+
+// reduce returns spn simplified and deduplicated: the network that the
+// solvers search. It returns false if ctx is done before or between the
+// passes.
+func reduce(ctx context.Context, spn SPN) (SPN, bool) {
+	if ctx.Err() != nil {
+		return SPN{}, false
+	}
+	simple, _, _ := spn.Simplify()
+	if ctx.Err() != nil {
+		return SPN{}, false
+	}
+	merged, _ := simple.Dedup()
+	return merged, ctx.Err() == nil
+}
@@ -0,0 +1,144 @@
+package maxspn
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// copySPN returns a copy of spn whose nodes are appended to nodes.
+func copySPN(spn SPN, nodes []Node) ([]Node, Node) {
+	base := len(nodes)
+	for _, n := range spn.Nodes {
+		var c Node
+		switch n := n.(type) {
+		case *Trm:
+			c = &Trm{Kth: n.Kth, Value: n.Value}
+		case *Sum:
+			es := make([]SumEdge, len(n.Edges))
+			for k, e := range n.Edges {
+				es[k] = SumEdge{e.Weight, nodes[base+e.Node.ID()]}
+			}
+			c = &Sum{Edges: es}
+		case *Prd:
+			es := make([]PrdEdge, len(n.Edges))
+			for k, e := range n.Edges {
+				es[k] = PrdEdge{nodes[base+e.Node.ID()]}
+			}
+			c = &Prd{Edges: es}
+		}
+		c.SetID(len(nodes))
+		nodes = append(nodes, c)
+	}
+	return nodes, nodes[len(nodes)-1]
+}
+
+func TestSPN_Dedup(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	schema := []int{2, 3, 2, 4, 2, 2, 3, 2}
+	for times := 0; times < 10; times++ {
+		spn := randomSPN(r, schema)
+		// Two copies of spn under one root merge into one.
+		nodes, a := copySPN(spn, nil)
+		nodes, b := copySPN(spn, nodes)
+		root := &Sum{Edges: []SumEdge{{math.Log(0.4), a}, {math.Log(0.6), b}}}
+		root.SetID(len(nodes))
+		twice := SPN{append(nodes, root), schema}
+
+		merged, ratio := twice.Dedup()
+		if len(merged.Nodes) != len(spn.Nodes)+1 {
+			t.Errorf("Dedup left %d of %d nodes, want %d", len(merged.Nodes), len(twice.Nodes), len(spn.Nodes)+1)
+		}
+		if before, after := twice.Size(), merged.Size(); ratio != float64(before.Nodes+before.Edges)/float64(after.Nodes+after.Edges) || ratio < 1.9 {
+			t.Errorf("ratio %v of %v to %v", ratio, before, after)
+		}
+		if again, ratio := merged.Dedup(); ratio != 1 || len(again.Nodes) != len(merged.Nodes) {
+			t.Errorf("second Dedup has ratio %v", ratio)
+		}
+		for i, n := range merged.Nodes {
+			if n.ID() != i {
+				t.Fatalf("node %d has ID %d", i, n.ID())
+			}
+		}
+
+		q := make(Query, len(schema))
+		for i := range q {
+			q[i] = []int{QueryVar, QueryVar, HiddenVar, 0, 1}[r.Intn(5)]
+		}
+		q[r.Intn(len(q))] = QueryVar
+		qs := twice.QuerySPN(q)
+		qm, _ := qs.Dedup()
+		for _, c := range []struct{ spn, merged SPN }{{twice, merged}, {qs, qm}} {
+			for k := 0; k < 20; k++ {
+				x := make([]int, len(c.spn.Schema))
+				for i := range x {
+					x[i] = r.Intn(c.spn.Schema[i]+1) - 1
+				}
+				if got, want := c.merged.EvalX(x), c.spn.EvalX(x); got != want {
+					t.Errorf("EvalX(%v) = %v, want %v", x, got, want)
+				}
+			}
+		}
+	}
+}
+
+// reorderedSPN returns a network over sums and products on the same children
+// in another order, or with weights one bit apart, which have the same value.
+func reorderedSPN() SPN {
+	a, b := &Trm{Kth: 0, Value: 0}, &Trm{Kth: 0, Value: 1}
+	w := math.Log(0.3)
+	nodes := []Node{
+		a, b,
+		&Sum{Edges: []SumEdge{{w, a}, {math.Log(0.7), b}}},
+		&Sum{Edges: []SumEdge{{math.Log(0.7), b}, {w, a}}},
+		&Sum{Edges: []SumEdge{{math.Nextafter(w, 0), a}, {math.Log(0.7), b}}},
+	}
+	x, y := &Trm{Kth: 1, Value: 0}, &Trm{Kth: 2, Value: 0}
+	nodes = append(nodes, x, y, &Prd{Edges: []PrdEdge{{x}, {y}}}, &Prd{Edges: []PrdEdge{{y}, {x}}})
+	es := []SumEdge{}
+	for _, n := range nodes[2:5] {
+		es = append(es, SumEdge{math.Log(0.1), n})
+	}
+	for _, n := range nodes[7:] {
+		es = append(es, SumEdge{math.Log(0.35), n})
+	}
+	nodes = append(nodes, &Sum{Edges: es})
+	for i, n := range nodes {
+		n.SetID(i)
+	}
+	return SPN{nodes, []int{2, 1, 1}}
+}
+
+func TestSPN_DedupOrder(t *testing.T) {
+	// The reordered sums and products are not merged.
+	spn := reorderedSPN()
+	if merged, ratio := spn.Dedup(); ratio != 1 || len(merged.Nodes) != len(spn.Nodes) {
+		t.Errorf("Dedup merged %d nodes into %d", len(spn.Nodes), len(merged.Nodes))
+	}
+}
+
+func TestSPN_DedupWith(t *testing.T) {
+	spn := reorderedSPN()
+	for _, c := range []struct {
+		opt  DedupOptions
+		want int
+	}{
+		{DedupOptions{}, 10},
+		{DedupOptions{Sorted: true}, 8},
+		{DedupOptions{Quantum: 1e-9}, 9},
+		{DedupOptions{Sorted: true, Quantum: 1e-9}, 7},
+	} {
+		merged, ratio := spn.DedupWith(c.opt)
+		if len(merged.Nodes) != c.want {
+			t.Errorf("DedupWith(%+v) left %d nodes, want %d", c.opt, len(merged.Nodes), c.want)
+		}
+		if ratio < 1 {
+			t.Errorf("DedupWith(%+v) has ratio %v", c.opt, ratio)
+		}
+		for _, x := range [][]int{{-1, -1, -1}, {0, 0, 0}, {1, 0, -1}} {
+			if got, want := merged.EvalX(x), spn.EvalX(x); math.Abs(got-want) > 1e-9 {
+				t.Errorf("DedupWith(%+v) EvalX(%v) = %v, want %v", c.opt, x, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package maxspn
+
+import (
+	"context"
+	"math"
+)
+
+// Derivatives holds the results of one pass of Differentiate, and is reused
+// across passes over the same network.
+type Derivatives struct {
+	Value []float64 // log-value of every node; the root is the last
+	Node  []float64 // log-derivative of the root with respect to every node
+	// State holds, for every state of every variable, the log-derivative of
+	// the root with respect to the indicator of the state: the sum of Node
+	// over its terminals. Differentiate leaves it alone if it is nil.
+	State  [][]float64
+	suffix []float64
+}
+
+// NewDerivatives returns the buffers of Differentiate for f.
+func (f *Flat) NewDerivatives() *Derivatives {
+	fanIn := 0
+	for i := 0; i < f.Len(); i++ {
+		if k := int(f.Start[i+1] - f.Start[i]); fanIn < k {
+			fanIn = k
+		}
+	}
+	state := make([][]float64, len(f.Schema))
+	for i, card := range f.Schema {
+		state[i] = make([]float64, card)
+	}
+	return &Derivatives{
+		Value:  make([]float64, f.Len()),
+		Node:   make([]float64, f.Len()),
+		State:  state,
+		suffix: make([]float64, fanIn),
+	}
+}
+
+// Root returns the log-value of the root.
+func (dv *Derivatives) Root() float64 {
+	return dv.Value[len(dv.Value)-1]
+}
+
+// Differentiate evaluates f at ass and back-propagates the derivatives of the
+// root into dv, in time linear in the edges. It returns false, leaving dv
+// undefined, if ctx is done before the passes end.
+//
+// A product child receives the product of its siblings as the sum of the
+// log-values before it and after it, so that zero children need no special
+// case and no value is ever divided out.
+func (f *Flat) Differentiate(ctx context.Context, ass [][]float64, dv *Derivatives) bool {
+	val, dr := dv.Value, dv.Node
+	if f.evalContext(ctx, ass, val) == nil {
+		return false
+	}
+	for i := range dr {
+		dr[i] = math.Inf(-1)
+	}
+	dr[len(dr)-1] = 0.0
+	for i := len(f.Kind) - 1; i >= 0; i-- {
+		if canceled(ctx, i) {
+			return false
+		}
+		if math.IsInf(dr[i], -1) {
+			continue
+		}
+		cs, ws := f.Child[f.Start[i]:f.Start[i+1]], f.Weight[f.Start[i]:f.Start[i+1]]
+		switch f.Kind[i] {
+		case FlatSum:
+			for k, c := range cs {
+				dr[c] = LogSumExp(dr[c], dr[i]+ws[k])
+			}
+		case FlatPrd:
+			suffix := dv.suffix[:len(cs)]
+			s := 0.0
+			for k := len(cs) - 1; k >= 0; k-- {
+				suffix[k] = s
+				s += val[cs[k]]
+			}
+			prefix := 0.0
+			for k, c := range cs {
+				dr[c] = LogSumExp(dr[c], dr[i]+prefix+suffix[k])
+				prefix += val[c]
+			}
+		}
+	}
+	if dv.State != nil {
+		for _, row := range dv.State {
+			for j := range row {
+				row[j] = math.Inf(-1)
+			}
+		}
+		for i, kind := range f.Kind {
+			if kind == FlatTrm {
+				k, v := f.Kth[i], f.Value[i]
+				dv.State[k][v] = LogSumExp(dv.State[k][v], dr[i])
+			}
+		}
+	}
+	return true
+}
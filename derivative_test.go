@@ -0,0 +1,115 @@
+package maxspn
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// evalWith is Flat.Eval with the log-value of node at replaced by v, and
+// returns the log-value of the root.
+func evalWith(f *Flat, ass [][]float64, at int, v float64) float64 {
+	val := make([]float64, f.Len())
+	for i, kind := range f.Kind {
+		cs, ws := f.Child[f.Start[i]:f.Start[i+1]], f.Weight[f.Start[i]:f.Start[i+1]]
+		switch {
+		case i == at:
+			val[i] = v
+		case kind == FlatTrm:
+			val[i] = math.Log(ass[f.Kth[i]][f.Value[i]])
+		case kind == FlatNum:
+			val[i] = f.Num[i]
+		case kind == FlatSum:
+			val[i] = logSumExpF(len(cs), func(k int) float64 { return ws[k] + val[cs[k]] })
+		case kind == FlatPrd:
+			for _, c := range cs {
+				val[i] += val[c]
+			}
+		}
+	}
+	return val[len(val)-1]
+}
+
+// checkDerivatives compares the derivatives of f at ass with forward
+// differences. The root is linear in the value of every node and in every
+// indicator, so each step is as long as makes the root double and the
+// differences are exact up to rounding.
+func checkDerivatives(t *testing.T, f *Flat, ass [][]float64) {
+	dv := f.NewDerivatives()
+	f.Differentiate(context.Background(), ass, dv)
+	root := dv.Root()
+	if want := f.Eval(ass)[f.Len()-1]; root != want {
+		t.Fatalf("Root = %v, want %v", root, want)
+	}
+	if math.IsInf(root, -1) {
+		return
+	}
+	step := func(d float64) float64 {
+		if math.IsInf(d, -1) {
+			return 1
+		}
+		return math.Exp(root - d)
+	}
+	// check reports the relative change of the root after a step h along a
+	// direction of log-derivative d.
+	check := func(name string, d, h, moved float64) {
+		want := 1.0
+		if math.IsInf(d, -1) {
+			want = 0
+		}
+		if got := math.Expm1(moved - root); math.Abs(got-want) > 1e-6 {
+			t.Errorf("%s: derivative %v, step %v changes the root by %v, want %v", name, d, h, got, want)
+		}
+	}
+	for i := range dv.Node {
+		h := step(dv.Node[i])
+		v := math.Log(math.Exp(dv.Value[i]) + h)
+		check(fmt.Sprint("node ", i), dv.Node[i], h, evalWith(f, ass, i, v))
+	}
+	for k := range dv.State {
+		for j, d := range dv.State[k] {
+			h := step(d)
+			old := ass[k][j]
+			ass[k][j] += h
+			check(fmt.Sprintf("state %d=%d", k, j), d, h, f.Eval(ass)[f.Len()-1])
+			ass[k][j] = old
+		}
+	}
+}
+
+func TestFlat_Differentiate(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	schema := []int{2, 3, 2, 4, 2, 2, 3, 2}
+	randomAss := func() [][]float64 {
+		as := make([][]float64, len(schema))
+		for i, card := range schema {
+			as[i] = make([]float64, card)
+			for j := range as[i] {
+				// Zero indicators make zero children of products.
+				if r.Intn(3) > 0 {
+					as[i][j] = 1 - r.Float64()
+				}
+			}
+		}
+		return as
+	}
+	for times := 0; times < 5; times++ {
+		spn := randomSPN(r, schema)
+		f := spn.Flatten()
+		ac, err := randomBN(r, schema).Compile(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g := ac.Flatten()
+		for k := 0; k < 5; k++ {
+			checkDerivatives(t, f, randomAss())
+			checkDerivatives(t, g, randomAss())
+		}
+		x := make([]int, len(schema))
+		if got, want := ac.Derivative(x), g.Derivative(X2Ass(x, schema)); !sameFloats(got, want) {
+			t.Errorf("AC.Derivative = %v, want %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package maxspn
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/big"
+	"math/bits"
+	"os"
+	"strings"
+)
+
+// DotOptions configures WriteDot.
+type DotOptions struct {
+	MaxDepth  int   // cut the nodes deeper than MaxDepth below the root, if positive
+	Highlight []int // IDs of the nodes to highlight, such as an InducedTree or PathTo
+}
+
+// WriteDot writes the subnetwork of spn rooted at node root as an annotated
+// Graphviz graph. Nodes are labelled with their type, ID and scope size, and
+// sum edges with their weights. Highlighted nodes, and the edges between
+// them, are drawn in bold red; the nodes whose children are cut by MaxDepth
+// are dashed.
+func (spn SPN) WriteDot(w io.Writer, root int, opt DotOptions) error {
+	if root < 0 || root >= len(spn.Nodes) {
+		return fmt.Errorf("root %d out of range [0, %d)", root, len(spn.Nodes))
+	}
+	dep := make([]int, len(spn.Nodes))
+	for i := range dep {
+		dep[i] = -1
+	}
+	dep[root] = 0
+	for i := root; i >= 0; i-- {
+		if dep[i] == -1 || opt.MaxDepth > 0 && dep[i] >= opt.MaxDepth {
+			continue
+		}
+		for _, c := range children(spn.Nodes[i]) {
+			if d := dep[c.ID()]; d == -1 || d > dep[i]+1 {
+				dep[c.ID()] = dep[i] + 1
+			}
+		}
+	}
+	hl := make([]bool, len(spn.Nodes))
+	for _, id := range opt.Highlight {
+		if id >= 0 && id < len(hl) {
+			hl[id] = true
+		}
+	}
+	scope := make([]*big.Int, len(spn.Nodes))
+	for i, n := range spn.Nodes[:root+1] {
+		scope[i] = new(big.Int)
+		if n, ok := n.(*Trm); ok {
+			scope[i].SetBit(scope[i], n.Kth, 1)
+		}
+		for _, c := range children(n) {
+			scope[i].Or(scope[i], scope[c.ID()])
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "digraph {")
+	fmt.Fprintln(bw, `node [shape=box fontsize=10]`)
+	for i := root; i >= 0; i-- {
+		if dep[i] == -1 {
+			continue
+		}
+		var label, color string
+		switch n := spn.Nodes[i].(type) {
+		case *Trm:
+			label, color = fmt.Sprintf("x%d=%d\\n#%d", n.Kth, n.Value, i), "darkgreen"
+		case *Sum:
+			label, color = fmt.Sprintf("+\\n#%d |%d|", i, scopeSize(scope[i])), "blue"
+		case *Prd:
+			label, color = fmt.Sprintf("×\\n#%d |%d|", i, scopeSize(scope[i])), "black"
+		}
+		style := ""
+		if hl[i] {
+			color, style = "red", " style=bold fontcolor=red"
+		} else if opt.MaxDepth > 0 && dep[i] == opt.MaxDepth && len(children(spn.Nodes[i])) > 0 {
+			style = " style=dashed"
+		}
+		fmt.Fprintf(bw, "n%d [label=\"%s\" color=%s%s]\n", i, label, color, style)
+	}
+	for i := root; i >= 0; i-- {
+		if dep[i] == -1 || opt.MaxDepth > 0 && dep[i] >= opt.MaxDepth {
+			continue
+		}
+		edge := func(c int, attrs ...string) {
+			if hl[i] && hl[c] {
+				attrs = append(attrs, "style=bold", "color=red")
+			}
+			fmt.Fprintf(bw, "n%d -> n%d [%s]\n", i, c, strings.Join(attrs, " "))
+		}
+		switch n := spn.Nodes[i].(type) {
+		case *Sum:
+			for _, e := range n.Edges {
+				edge(e.Node.ID(), fmt.Sprintf(`label="%.3g"`, math.Exp(e.Weight)))
+			}
+		case *Prd:
+			for _, e := range n.Edges {
+				edge(e.Node.ID())
+			}
+		}
+	}
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+// PlotDot writes the graph of WriteDot to filename.
+func (spn SPN) PlotDot(filename string, root int, opt DotOptions) {
+	file, err := os.Create(filename)
+	if err != nil {
+		log.Fatalf("Open file error: %v\n", err)
+	}
+	defer file.Close()
+	if err := spn.WriteDot(file, root, opt); err != nil {
+		log.Fatalf("%s: %v\n", filename, err)
+	}
+}
+
+func scopeSize(s *big.Int) int {
+	cnt := 0
+	for _, w := range s.Bits() {
+		cnt += bits.OnesCount(uint(w))
+	}
+	return cnt
+}
+
+// InducedTree returns the IDs, in increasing order, of the nodes of the
+// induced tree of maximum value among those consistent with x, in which
+// x[i] == -1 leaves variable i free. For x = MaxMax(spn) it is the tree that
+// MaxMax chose; for the assignment of another method, such as SumMax, it is
+// the best tree supporting that assignment. It returns nil if no tree is
+// consistent with x.
+func (spn SPN) InducedTree(x []int) []int {
+	val := make([]float64, len(spn.Nodes))
+	branch := make([]int, len(spn.Nodes))
+	for i, n := range spn.Nodes {
+		switch n := n.(type) {
+		case *Trm:
+			val[i] = 0
+			if x[n.Kth] != -1 && x[n.Kth] != n.Value {
+				val[i] = math.Inf(-1)
+			}
+		case *Sum:
+			val[i], branch[i] = math.Inf(-1), -1
+			for j, e := range n.Edges {
+				if v := e.Weight + val[e.Node.ID()]; val[i] < v {
+					val[i], branch[i] = v, j
+				}
+			}
+		case *Prd:
+			val[i] = 0
+			for _, e := range n.Edges {
+				val[i] += val[e.Node.ID()]
+			}
+		}
+	}
+	if math.IsInf(val[len(val)-1], -1) {
+		return nil
+	}
+	in := make([]bool, len(spn.Nodes))
+	in[len(in)-1] = true
+	for i := len(spn.Nodes) - 1; i >= 0; i-- {
+		if !in[i] {
+			continue
+		}
+		switch n := spn.Nodes[i].(type) {
+		case *Sum:
+			in[n.Edges[branch[i]].Node.ID()] = true
+		case *Prd:
+			for _, e := range n.Edges {
+				in[e.Node.ID()] = true
+			}
+		}
+	}
+	tree := []int{}
+	for i := range in {
+		if in[i] {
+			tree = append(tree, i)
+		}
+	}
+	return tree
+}
+
+// PathTo returns the IDs of the nodes of a shortest path from the root of
+// spn down to node id, root first, or nil if id is not reachable.
+func (spn SPN) PathTo(id int) []int {
+	if id < 0 || id >= len(spn.Nodes) {
+		return nil
+	}
+	root := len(spn.Nodes) - 1
+	parent := make([]int, len(spn.Nodes))
+	for i := range parent {
+		parent[i] = -1
+	}
+	parent[root] = root
+	queue := []int{root}
+	for len(queue) > 0 && parent[id] == -1 {
+		i := queue[0]
+		queue = queue[1:]
+		for _, c := range children(spn.Nodes[i]) {
+			if parent[c.ID()] == -1 {
+				parent[c.ID()] = i
+				queue = append(queue, c.ID())
+			}
+		}
+	}
+	if parent[id] == -1 {
+		return nil
+	}
+	path := []int{id}
+	for i := id; i != root; i = parent[i] {
+		path = append(path, parent[i])
+	}
+	for l, r := 0, len(path)-1; l < r; l, r = l+1, r-1 {
+		path[l], path[r] = path[r], path[l]
+	}
+	return path
+}
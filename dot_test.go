@@ -0,0 +1,87 @@
+package maxspn
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSPN_InducedTree(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for times := 0; times < 10; times++ {
+		spn := randomSPN(r, []int{2, 3, 2, 2, 3})
+		x := MaxMax(spn)
+		tree := spn.InducedTree(x)
+		if tree[len(tree)-1] != len(spn.Nodes)-1 {
+			t.Fatalf("tree %v misses the root", tree)
+		}
+		// The tree is a tree: one terminal per variable, agreeing with x.
+		seen := make([]bool, len(x))
+		for _, id := range tree {
+			if n, ok := spn.Nodes[id].(*Trm); ok {
+				if seen[n.Kth] || n.Value != x[n.Kth] {
+					t.Fatalf("terminal %d of tree %v disagrees with %v", id, tree, x)
+				}
+				seen[n.Kth] = true
+			}
+		}
+		free := make([]int, len(x))
+		for i := range free {
+			free[i] = -1
+		}
+		if got := spn.InducedTree(free); !reflect.DeepEqual(got, tree) {
+			t.Errorf("free tree %v, MaxMax tree %v", got, tree)
+		}
+	}
+}
+
+func TestSPN_WriteDot(t *testing.T) {
+	spn := randomSPN(rand.New(rand.NewSource(2)), []int{2, 2, 2, 2})
+	root := len(spn.Nodes) - 1
+	path := spn.PathTo(0)
+	if path[0] != root || path[len(path)-1] != 0 {
+		t.Fatalf("path %v", path)
+	}
+	for i := 1; i < len(path); i++ {
+		found := false
+		for _, c := range children(spn.Nodes[path[i-1]]) {
+			found = found || c.ID() == path[i]
+		}
+		if !found {
+			t.Fatalf("path %v: %d is not a child of %d", path, path[i], path[i-1])
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := spn.WriteDot(&buf, root, DotOptions{Highlight: path}); err != nil {
+		t.Fatal(err)
+	}
+	full := buf.String()
+	nodes, red := 0, 0
+	for _, ln := range strings.Split(full, "\n") {
+		switch {
+		case strings.Contains(ln, "->"):
+			if strings.Contains(ln, "color=red") {
+				red++
+			}
+		case strings.Contains(ln, "[label="):
+			nodes++
+		}
+	}
+	if nodes != len(spn.Nodes) || red != len(path)-1 {
+		t.Errorf("full graph:\n%s", full)
+	}
+	buf.Reset()
+	if err := spn.WriteDot(&buf, root, DotOptions{MaxDepth: 1}); err != nil {
+		t.Fatal(err)
+	}
+	cut := buf.String()
+	if n := strings.Count(cut, "->"); n != len(children(spn.Nodes[root])) {
+		t.Errorf("depth 1 graph has %d edges:\n%s", n, cut)
+	}
+	if err := spn.WriteDot(&buf, len(spn.Nodes), DotOptions{}); err == nil {
+		t.Errorf("out of range root accepted")
+	}
+}
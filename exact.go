@@ -1,225 +1,260 @@
-package main
+package maxspn
 
 import (
+	"context"
 	"math"
-	"sort"
 )
 
-func ExactOrder(spn SPN, baseline float64) float64 {
+func ExactOrder(ctx context.Context, spn SPN, baseline float64) float64 {
 	x := make([]int, len(spn.Schema))
 	for i := range x {
 		x[i] = -1
 	}
-	return dfs2(spn, x, baseline)
+	return dfs2(ctx, NewWorkspace(spn), x, baseline)
 }
 
-func dfs2(spn SPN, x []int, baseline float64) float64 {
+func dfs2(ctx context.Context, w *Workspace, x []int, baseline float64) float64 {
 	//log.Println(len(spn.Schema), baseline)
-	x2 := make([]int, len(x))
+	select {
+	case <-ctx.Done():
+		return baseline
+	default:
+	}
+
+	x2 := w.vars()
+	defer w.releaseVars(x2)
 	copy(x2, x)
 	x = x2
 	for i := range x {
 		if x[i] == -1 {
-			x[i] = 0
-			xi0 := eval2(spn, x)
-			x[i] = 1
-			xi1 := eval2(spn, x)
+			live, liveVal := 0, -1
+			for v := 0; v < w.f.Schema[i]; v++ {
+				x[i] = v
+				if w.EvalX(x) >= baseline {
+					live++
+					liveVal = v
+				}
+			}
 			x[i] = -1
-			if xi0 < baseline && xi1 < baseline {
+			if live == 0 {
 				return baseline
 			}
-			if xi0 < baseline {
-				x[i] = 1
-			}
-			if xi1 < baseline {
-				x[i] = 0
+			if live == 1 {
+				x[i] = liveVal
 			}
 		}
 	}
 	for i := range x {
 		if x[i] == -1 {
-			x[i] = 0
-			baseline = math.Max(dfs2(spn, x, baseline), baseline)
-			x[i] = 1
-			baseline = math.Max(dfs2(spn, x, baseline), baseline)
+			for v := 0; v < w.f.Schema[i]; v++ {
+				x[i] = v
+				baseline = math.Max(dfs2(ctx, w, x, baseline), baseline)
+			}
 			return baseline
 		}
 	}
-	return math.Max(baseline, spn.EvalX(x))
-}
-
-func eval2(spn SPN, x []int) float64 {
-	a := make([][]float64, len(spn.Schema))
-	for i := range a {
-		a[i] = make([]float64, 2)
-		if x[i] == -1 {
-			a[i][0] = 1
-			a[i][1] = 1
-		} else {
-			a[i][x[i]] = 1
-		}
-	}
-	return spn.Eval(a)[len(spn.Nodes)-1]
+	return math.Max(baseline, w.EvalX(x))
 }
 
-func ExactOrderDer(spn SPN, baseline float64) float64 {
+func ExactOrderDer(ctx context.Context, spn SPN, baseline float64) float64 {
 	x := make([]int, len(spn.Schema))
 	for i := range x {
 		x[i] = -1
 	}
-	return dfs2Der(spn, x, baseline)
+	return dfs2Der(ctx, NewWorkspace(spn), x, baseline)
 }
 
-func dfs2Der(spn SPN, x []int, baseline float64) float64 {
-	x2 := make([]int, len(x))
+func dfs2Der(ctx context.Context, w *Workspace, x []int, baseline float64) float64 {
+	select {
+	case <-ctx.Done():
+		return baseline
+	default:
+	}
+
+	x2, vs, as, d := w.vars(), w.vars(), w.matrix(), w.matrix()
+	defer w.releaseVars(x2)
+	defer w.releaseVars(vs)
+	defer w.release(as)
+	defer w.release(d)
 	copy(x2, x)
 	x = x2
-	as := make([][]float64, len(x))
-	for i := range as {
-		as[i] = make([]float64, 2)
-		if x[i] == 0 || x[i] == -1 {
-			as[i][0] = 1
+	fillAssignment(as, x)
+	for {
+		if !w.Derivative(ctx, as, d) {
+			return baseline
+		}
+		updated, ok := forwardCheckingStep(x, as, d, baseline)
+		if !ok {
+			return baseline
 		}
-		if x[i] == 1 || x[i] == -1 {
-			as[i][1] = 1
+		if !updated {
+			break
 		}
 	}
-	var d [][]float64
-	for {
-		updated := false
-		d = derivativeOfAssignment(spn, as)
-		for i := range x {
-			if x[i] == -1 {
-				xi0 := d[i][0]
-				xi1 := d[i][1]
+	if i, vs := orderX(x, as, d, vs); i != -1 {
+		for _, v := range vs {
+			x[i] = v
+			baseline = math.Max(dfs2Der(ctx, w, x, baseline), baseline)
+		}
+		return baseline
+	}
+	return math.Max(baseline, maximum(d[0]))
+}
 
-				if xi0 < baseline && xi1 < baseline {
-					return baseline
-				}
-				if xi0 < baseline {
-					x[i] = 1
-					as[i][0] = 0
-					updated = true
-				}
-				if xi1 < baseline {
-					x[i] = 0
-					as[i][1] = 0
-					updated = true
+// forwardCheckingStep removes from as every value of a free variable of x
+// whose derivative in d is below baseline, and fixes the variables left with
+// a single value. It reports whether as changed, and false if a variable has
+// no value left.
+func forwardCheckingStep(x []int, as [][]float64, d [][]float64, baseline float64) (updated, ok bool) {
+	for i := range x {
+		if x[i] == -1 {
+			live, liveVal := 0, -1
+			for j := range as[i] {
+				if as[i][j] != 0 {
+					if d[i][j] < baseline {
+						as[i][j] = 0
+						updated = true
+					} else {
+						live++
+						liveVal = j
+					}
 				}
 			}
-		}
-		if !updated {
-			break
+			if live == 0 {
+				return updated, false
+			}
+			if live == 1 {
+				x[i] = liveVal
+			}
 		}
 	}
+	return updated, true
+}
+
+// orderX returns the free variable of x with the largest derivative and its
+// values left in as, largest derivative first, in vs. It returns -1 if x is
+// complete.
+func orderX(x []int, as [][]float64, d [][]float64, vs []int) (int, []int) {
 	maxVarID := -1
-	maxValID := -1
 	maxDer := math.Inf(-1)
 	for i := range x {
 		if x[i] == -1 {
-			crtValID := 0
-			crtDer := d[i][0]
-			if d[i][0] < d[i][1] {
-				crtValID = 1
-				crtDer = d[i][1]
-			}
+			crtDer := maximum(d[i])
 			if maxVarID == -1 || maxDer < crtDer {
 				maxVarID = i
-				maxValID = crtValID
 				maxDer = crtDer
 			}
 		}
 	}
-	if i := maxVarID; i != -1 {
-		x[i] = maxValID
-		baseline = math.Max(dfs2Der(spn, x, baseline), baseline)
-		x[i] = maxValID ^ 1
-		baseline = math.Max(dfs2Der(spn, x, baseline), baseline)
-		return baseline
+	if maxVarID == -1 {
+		return -1, nil
 	}
-	return math.Max(baseline, math.Max(d[0][0], d[0][1]))
+	vs = vs[:0]
+	for j := range as[maxVarID] {
+		if as[maxVarID][j] != 0 {
+			vs = append(vs, j)
+		}
+	}
+	sortValues(vs, d[maxVarID])
+	return maxVarID, vs
 }
 
-func eval2Der(spn SPN, x []int) float64 {
-	a := make([][]float64, len(spn.Schema))
-	for i := range a {
-		a[i] = make([]float64, 2)
-		if x[i] == -1 {
-			a[i][0] = 1
-			a[i][1] = 1
-		} else {
-			a[i][x[i]] = 1
+// liveCount returns the number of values left in the row as of an
+// assignment.
+func liveCount(as []float64) int {
+	cnt := 0
+	for _, a := range as {
+		if a != 0 {
+			cnt++
 		}
 	}
-	return spn.Eval(a)[len(spn.Nodes)-1]
+	return cnt
 }
 
-func Exact(spn SPN, baseline float64) float64 {
+func Exact(ctx context.Context, spn SPN, baseline float64) float64 {
 	x := make([]int, len(spn.Schema))
-	return dfs(spn, x, 0, baseline)
+	return dfs(ctx, NewWorkspace(spn), x, 0, baseline)
 }
 
-func dfs(spn SPN, x []int, xi int, baseline float64) float64 {
-	if xi == len(spn.Schema) {
-		return math.Max(baseline, eval(spn, x, xi))
+func dfs(ctx context.Context, w *Workspace, x []int, xi int, baseline float64) float64 {
+	select {
+	case <-ctx.Done():
+		return baseline
+	default:
 	}
-	x[xi] = 0
-	if eval(spn, x, xi+1) > baseline {
-		baseline = math.Max(baseline, dfs(spn, x, xi+1, baseline))
+
+	if xi == len(x) {
+		return math.Max(baseline, w.evalPrefix(x, xi))
 	}
-	x[xi] = 1
-	if eval(spn, x, xi+1) > baseline {
-		baseline = math.Max(baseline, dfs(spn, x, xi+1, baseline))
+	for v := 0; v < w.f.Schema[xi]; v++ {
+		x[xi] = v
+		if w.evalPrefix(x, xi+1) > baseline {
+			baseline = math.Max(baseline, dfs(ctx, w, x, xi+1, baseline))
+		}
 	}
 	return baseline
 }
 
-func eval(spn SPN, x []int, xi int) float64 {
-	a := make([][]float64, len(spn.Schema))
-	for i := range a {
-		a[i] = make([]float64, 2)
-		if i < xi {
-			a[i][x[i]] = 1
-		} else {
-			a[i][0] = 1
-			a[i][1] = 1
-		}
-	}
-	return spn.Eval(a)[len(spn.Nodes)-1]
+func ExactSolver(ctx context.Context, spn SPN) float64 {
+	return exactSolver(ctx, spn).P
 }
 
-func ExactSolver(spn SPN) float64 {
-	as := make([][]float64, len(spn.Schema))
-	for i := range as {
-		as[i] = make([]float64, spn.Schema[i])
-		for j := range as[i] {
-			as[i][j] = 1
-		}
-	}
-	as, d := forwardChecking(spn, math.Inf(-1), as)
-	return searchMax(spn, math.Inf(-1), as, d)
+func exactSolver(ctx context.Context, spn SPN) Result {
+	w := NewWorkspace(spn)
+	as, d := w.free(), w.matrix()
+	s := newSearch(ctx, w, as, math.Inf(-1))
+	s.forwardChecking(w, as, d)
+	s.searchMax(w, as, d, s.upper)
+	return s.result()
 }
-func searchMax(spn SPN, best float64, as [][]float64, d [][]float64) float64 {
+
+func (s *search) searchMax(w *Workspace, as [][]float64, d [][]float64, bound float64) {
+	if s.done() {
+		s.interrupt(bound)
+		return
+	}
+	s.stats.Expanded++
 	if isCompleteAssignment(as) {
-		p := maximum(d[0])
-		if best < p {
-			best = p
+		x := w.vars()
+		for i := range as {
+			for j := range as[i] {
+				if as[i][j] == 1 {
+					x[i] = j
+				}
+			}
 		}
-		return best
+		for j := range d[0] {
+			if d[0][x[0]] < d[0][j] {
+				x[0] = j
+			}
+		}
+		s.update(x, d[0][x[0]])
+		w.releaseVars(x)
+		return
 	}
-	varID, valIDs := order(as, d)
+	varID, valIDs := order(as, d, w.vars())
+	asNew, dNew := w.matrix(), w.matrix()
 	for _, valID := range valIDs {
-		as[varID] = make([]float64, spn.Schema[varID])
-		as[varID][valID] = 1
-		asNew, dNew := forwardChecking(spn, best, as)
+		copyMatrix(asNew, as)
+		for j := range asNew[varID] {
+			asNew[varID][j] = 0
+		}
+		asNew[varID][valID] = 1
+		s.forwardChecking(w, asNew, dNew)
 		if maximum(asNew[0]) != 0 {
-			best = searchMax(spn, best, asNew, dNew)
+			s.searchMax(w, asNew, dNew, d[varID][valID])
+		} else {
+			s.stats.Pruned++
 		}
 	}
-	return best
+	w.release(dNew)
+	w.release(asNew)
+	w.releaseVars(valIDs)
 }
 
-func order(as [][]float64, d [][]float64) (int, []int) {
+// order returns the live variable of as with the fewest values left, and its
+// values left in ids, largest derivative first.
+func order(as [][]float64, d [][]float64, ids []int) (int, []int) {
 	varID := 0
 	varIDCnt := math.MaxInt64
 	varIDD := math.Inf(-1)
@@ -238,15 +273,13 @@ func order(as [][]float64, d [][]float64) (int, []int) {
 			varIDD = maxD
 		}
 	}
-	ids := make([]int, varIDCnt)
-	idc := 0
+	ids = ids[:0]
 	for i := range as[varID] {
 		if as[varID][i] == 1 {
-			ids[idc] = i
-			idc++
+			ids = append(ids, i)
 		}
 	}
-	sort.Slice(ids, func(i, j int) bool { return d[varID][i] > d[varID][j] })
+	sortValues(ids, d[varID])
 	return varID, ids
 }
 
@@ -276,15 +309,19 @@ func maximum(fs []float64) float64 {
 	return r
 }
 
-func forwardChecking(spn SPN, best float64, as [][]float64) ([][]float64, [][]float64) {
-	as = cloneAssignment(as)
+// forwardChecking prunes from as the values that cannot beat the incumbent
+// and stores the derivatives of the pruned assignment in d. It returns false,
+// leaving d undefined, if the search is done.
+func (s *search) forwardChecking(w *Workspace, as, d [][]float64) bool {
 	for {
-		d := derivativeOfAssignment(spn, as)
+		if !s.derivative(w, as, d) {
+			return false
+		}
 		changed := false
 		for i := range as {
 			for j := range as[i] {
 				if as[i][j] != 0 {
-					if best >= d[i][j] {
+					if s.best.P >= d[i][j] {
 						as[i][j] = 0
 						changed = true
 					}
@@ -292,139 +329,146 @@ func forwardChecking(spn SPN, best float64, as [][]float64) ([][]float64, [][]fl
 			}
 		}
 		if !changed {
-			return as, d
-		}
-	}
-}
-
-func cloneAssignment(as [][]float64) [][]float64 {
-	bs := make([][]float64, len(as))
-	for i := range bs {
-		bs[i] = make([]float64, len(as[i]))
-		copy(bs[i], as[i])
-	}
-	return bs
-}
-func derivativeOfAssignment(spn SPN, as [][]float64) [][]float64 {
-	der := DerivativeS(spn, as)
-	d := make([][]float64, len(spn.Schema))
-	for i := range d {
-		d[i] = make([]float64, spn.Schema[i])
-		for j := range d[i] {
-			d[i][j] = math.Inf(-1)
+			return true
 		}
 	}
-	for i, n := range spn.Nodes {
-		if n, ok := n.(*Trm); ok {
-			d[n.Kth][n.Value] = logSumExp(d[n.Kth][n.Value], der[i])
-		}
-	}
-	return d
 }
 
-func ExactSolverBin(spn SPN) float64 {
-	as := make([][]float64, len(spn.Schema))
+// freeAssignment returns the assignment that leaves every variable free.
+func freeAssignment(schema []int) [][]float64 {
+	as := make([][]float64, len(schema))
 	for i := range as {
-		as[i] = make([]float64, spn.Schema[i])
+		as[i] = make([]float64, schema[i])
 		for j := range as[i] {
 			as[i][j] = 1
 		}
 	}
-	as, d := forwardCheckingBin(spn, math.Inf(-1), as)
-	return searchMaxBin(spn, math.Inf(-1), as, d)
+	return as
+}
+
+func ExactSolverBin(ctx context.Context, spn SPN) float64 {
+	w := NewWorkspace(spn)
+	as, d := w.free(), w.matrix()
+	forwardCheckingBin(ctx, w, math.Inf(-1), as, d)
+	return searchMaxBin(ctx, w, math.Inf(-1), as, d)
 }
 
-func searchMaxBin(spn SPN, best float64, as [][]float64, d [][]float64) float64 {
+func searchMaxBin(ctx context.Context, w *Workspace, best float64, as [][]float64, d [][]float64) float64 {
+	select {
+	case <-ctx.Done():
+		return best
+	default:
+	}
+
 	if isCompleteAssignmentBin(as) {
-		return math.Max(best, math.Max(d[0][0], d[0][1]))
+		return math.Max(best, maximum(d[0]))
 	}
-	varID, valIDs := orderBin(as, d)
+	varID, valIDs := orderBin(as, d, w.vars())
+	asNew, dNew := w.matrix(), w.matrix()
+	defer w.releaseVars(valIDs)
+	defer w.release(asNew)
+	defer w.release(dNew)
 	for _, valID := range valIDs {
-		as[varID] = make([]float64, 2)
-		as[varID][valID] = 1
-		asNew, dNew := forwardCheckingBin(spn, best, as)
-		if asNew[0][0] > 0 || asNew[0][1] > 0 {
-			best = searchMaxBin(spn, best, asNew, dNew)
+		copyMatrix(asNew, as)
+		for j := range asNew[varID] {
+			asNew[varID][j] = 0
+		}
+		asNew[varID][valID] = 1
+		forwardCheckingBin(ctx, w, best, asNew, dNew)
+		if maximum(asNew[0]) > 0 {
+			best = searchMaxBin(ctx, w, best, asNew, dNew)
 		}
 	}
 	return best
 }
 
-func orderBin(as [][]float64, d [][]float64) (int, []int) {
+// orderBin returns the variable of as with values left and the largest
+// derivative, and its values left in ids, largest derivative first. It
+// returns -1 if as is complete.
+func orderBin(as [][]float64, d [][]float64, ids []int) (int, []int) {
 	varID := -1
 	varIDD := math.Inf(-1)
 	for i := range as {
-		if as[i][0] > 0 && as[i][1] > 0 {
-			maxD := math.Max(d[i][0], d[i][1])
+		if liveCount(as[i]) > 1 {
+			maxD := maximum(d[i])
 			if varIDD < maxD {
 				varID = i
 				varIDD = maxD
 			}
 		}
 	}
-	var ids []int
+	ids = ids[:0]
 	if varID != -1 {
-		if d[varID][0] > d[varID][1] {
-			ids = []int{0, 1}
-		} else {
-			ids = []int{1, 0}
+		for j, a := range as[varID] {
+			if a != 0 {
+				ids = append(ids, j)
+			}
 		}
+		sortValues(ids, d[varID])
 	}
 	return varID, ids
 }
 
 func isCompleteAssignmentBin(as [][]float64) bool {
 	for i := range as {
-		if as[i][0] > 0 && as[i][1] > 0 {
+		if liveCount(as[i]) > 1 {
 			return false
 		}
 	}
 	return true
 }
 
-func forwardCheckingBin(spn SPN, best float64, as [][]float64) ([][]float64, [][]float64) {
-	as = cloneAssignment(as)
+// forwardCheckingBin prunes from as the values that cannot beat best, and
+// stores the derivatives of the pruned assignment in d. It leaves d undefined
+// if ctx is done before the passes end.
+func forwardCheckingBin(ctx context.Context, w *Workspace, best float64, as, d [][]float64) {
 	for {
-		d := derivativeOfAssignment(spn, as)
+		if !w.Derivative(ctx, as, d) {
+			return
+		}
 		changed := false
 		for i := range as {
-			if as[i][0] != 0 && best >= d[i][0] {
-				as[i][0] = 0
-				changed = true
-			}
-			if as[i][1] != 0 && best >= d[i][1] {
-				as[i][1] = 0
-				changed = true
+			for j := range as[i] {
+				if as[i][j] != 0 && best >= d[i][j] {
+					as[i][j] = 0
+					changed = true
+				}
 			}
 		}
 		if !changed {
-			return as, d
+			return
 		}
 	}
 }
 
-func ExactStage(spn SPN, x []int, best float64) float64 {
-	x2 := make([]int, len(x))
+func ExactStage(ctx context.Context, spn SPN, x []int, best float64) float64 {
+	return dfsStage(ctx, NewWorkspace(spn), x, best)
+}
+
+// dfsStage is ExactStage on the network of w. Staging builds the network of
+// the next stage and a new workspace for it, whose buffers each stage
+// allocates afresh; within a stage the search reuses them.
+func dfsStage(ctx context.Context, w *Workspace, x []int, best float64) float64 {
+	select {
+	case <-ctx.Done():
+		return best
+	default:
+	}
+
+	x2, as, d := w.vars(), w.matrix(), w.matrix()
+	defer w.releaseVars(x2)
+	defer w.release(as)
+	defer w.release(d)
 	copy(x2, x)
 	x = x2
-	var d [][]float64
 	for {
-		updated := false
-		d = derivativeOfAssignmentX(spn, x)
-		for i := range x {
-			if x[i] == -1 {
-				if d[i][0] <= best && d[i][1] <= best {
-					return best
-				}
-				if d[i][0] <= best {
-					x[i] = 1
-					updated = true
-				}
-				if d[i][1] <= best {
-					x[i] = 0
-					updated = true
-				}
-			}
+		fillAssignment(as, x)
+		if !w.Derivative(ctx, as, d) {
+			return best
+		}
+		updated, ok := fixX(x, d, best)
+		if !ok {
+			return best
 		}
 		if !updated {
 			break
@@ -437,67 +481,114 @@ func ExactStage(spn SPN, x []int, best float64) float64 {
 		}
 	}
 	if cnt > 1 && len(x)-cnt >= 8 {
-		spn = spn.StageSPN(x)
-		x = make([]int, len(spn.Schema))
+		w = NewWorkspace(w.SPN().StageSPN(x))
+		x, as, d = w.vars(), w.free(), w.matrix()
+		defer w.releaseVars(x)
+		defer w.release(as)
+		defer w.release(d)
 		for i := range x {
 			x[i] = -1
 		}
-		d = derivativeOfAssignmentX(spn, x)
+		if !w.Derivative(ctx, as, d) {
+			return best
+		}
 	}
-	varID := -1
-	valID := -1
+	vs := w.vars()
+	defer w.releaseVars(vs)
+	varID, valIDs := pickX(x, d, best, vs)
+	if varID == -1 {
+		return math.Max(best, d[0][x[0]])
+	}
+	if cnt == 1 {
+		return d[varID][valIDs[0]]
+	}
+	for _, valID := range valIDs {
+		x[varID] = valID
+		best = dfsStage(ctx, w, x, best)
+	}
+	return best
+}
+
+// fixX fixes every free variable of x left with a single value whose
+// derivative in d exceeds best. It reports whether x changed, and false if a
+// free variable has no such value.
+func fixX(x []int, d [][]float64, best float64) (updated, ok bool) {
 	for i := range x {
 		if x[i] == -1 {
-			var valI int
-			if d[i][0] < d[i][1] {
-				valI = 1
-			} else {
-				valI = 0
+			live, liveVal := 0, -1
+			for j := range d[i] {
+				if d[i][j] > best {
+					live++
+					liveVal = j
+				}
 			}
-			if varID == -1 || d[varID][valID] < d[i][valI] {
+			if live == 0 {
+				return updated, false
+			}
+			if live == 1 {
+				x[i] = liveVal
+				updated = true
+			}
+		}
+	}
+	return updated, true
+}
+
+// pickX returns the free variable of x with the largest derivative and its
+// values whose derivative exceeds best, largest first, in vs. It returns -1
+// if x is complete.
+func pickX(x []int, d [][]float64, best float64, vs []int) (int, []int) {
+	varID := -1
+	varD := math.Inf(-1)
+	for i := range x {
+		if x[i] == -1 {
+			if crt := maximum(d[i]); varID == -1 || varD < crt {
 				varID = i
-				valID = valI
+				varD = crt
 			}
 		}
 	}
 	if varID == -1 {
-		return math.Max(best, d[0][x[0]])
+		return -1, nil
 	}
-	if cnt == 1 {
-		return d[varID][valID]
+	vs = vs[:0]
+	for j := range d[varID] {
+		if d[varID][j] > best {
+			vs = append(vs, j)
+		}
 	}
-	x[varID] = valID
-	best = ExactStage(spn, x, best)
-	x[varID] = 1 - valID
-	best = ExactStage(spn, x, best)
-	return best
+	sortValues(vs, d[varID])
+	return varID, vs
 }
 
-func derivativeOfAssignmentX(spn SPN, x []int) [][]float64 {
-	return derivativeOfAssignment(spn, X2Ass(x, spn.Schema))
+func ExactFastStage(ctx context.Context, spn SPN, x []int, best float64, fastStaged int) float64 {
+	return dfsFastStage(ctx, NewWorkspace(spn), x, best, fastStaged)
 }
-func ExactFastStage(spn SPN, x []int, best float64, fastStaged int) float64 {
-	x2 := make([]int, len(x))
+
+// dfsFastStage is ExactFastStage on the network of w. Fast staging builds the
+// network of the next stage and a new workspace for it, whose buffers each
+// stage allocates afresh; within a stage the search reuses them.
+func dfsFastStage(ctx context.Context, w *Workspace, x []int, best float64, fastStaged int) float64 {
+	select {
+	case <-ctx.Done():
+		return best
+	default:
+	}
+
+	x2, as, d := w.vars(), w.matrix(), w.matrix()
+	defer w.releaseVars(x2)
+	defer w.release(as)
+	defer w.release(d)
 	copy(x2, x)
 	x = x2
-	var d [][]float64
 	for {
-		updated := false
-		d = derivativeOfAssignmentX(spn, x)
-		for i := range x {
-			if x[i] == -1 {
-				if d[i][0] <= best && d[i][1] <= best {
-					return best
-				}
-				if d[i][0] <= best {
-					x[i] = 1
-					updated = true
-				}
-				if d[i][1] <= best {
-					x[i] = 0
-					updated = true
-				}
-			}
+		fillAssignment(as, x)
+		if !w.Derivative(ctx, as, d) {
+			return best
+		}
+		updated, ok := fixX(x, d, best)
+		if !ok {
+			return best
 		}
 		if !updated {
 			break
@@ -519,35 +610,379 @@ func ExactFastStage(spn SPN, x []int, best float64, fastStaged int) float64 {
 	//	fastStaged = 0
 	//} else
 	if cnt > 1 && len(x)-cnt-fastStaged >= 30 {
-		spn = spn.FastStageSPN(x)
+		w = NewWorkspace(w.SPN().FastStageSPN(x))
 		fastStaged = len(x) - cnt
 	}
 
-	varID := -1
-	valID := -1
+	vs := w.vars()
+	defer w.releaseVars(vs)
+	varID, valIDs := pickX(x, d, best, vs)
+	if varID == -1 {
+		return math.Max(best, d[0][x[0]])
+	}
+	if cnt == 1 {
+		return d[varID][valIDs[0]]
+	}
+	for _, valID := range valIDs {
+		x[varID] = valID
+		best = dfsFastStage(ctx, w, x, best, fastStaged)
+	}
+	return best
+}
+
+// search holds the incumbent and the counters of one branch-and-bound run.
+type search struct {
+	ctx      context.Context
+	best     XP
+	stats    Stats
+	progress *progress
+	upper    float64 // upper bound of the whole search space
+	open     float64 // maximum upper bound of the subtrees left unexplored
+}
+
+// newSearch starts a search of the assignments of the network of w that
+// extend as. It spends one derivative pass on the upper bound of the search
+// space.
+func newSearch(ctx context.Context, w *Workspace, as [][]float64, baseline float64) *search {
+	s := &search{ctx: ctx, best: XP{P: baseline}, progress: progressOf(ctx), open: math.Inf(-1)}
+	s.stats.Derivatives++
+	s.upper = upperBound(ctx, w, as)
+	return s
+}
+
+func (s *search) done() bool {
+	select {
+	case <-s.ctx.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// update makes x the incumbent if p improves on it.
+func (s *search) update(x []int, p float64) {
+	if s.best.P < p {
+		s.best = XP{append([]int(nil), x...), p}
+		s.progress.report(s.best, s.upper)
+	}
+}
+
+func (s *search) derivative(w *Workspace, as, d [][]float64) bool {
+	s.stats.Derivatives++
+	return w.Derivative(s.ctx, as, d)
+}
+
+// interrupt records bound as the upper bound of a subtree that the search
+// leaves unexplored because its context is done.
+func (s *search) interrupt(bound float64) {
+	s.open = math.Max(s.open, bound)
+}
+
+// result returns the incumbent with the upper bound of the search: the
+// incumbent itself if the search space has been exhausted, and otherwise
+// the best bound of the subtrees left open.
+func (s *search) result() Result {
+	upper := math.Min(s.upper, math.Max(s.best.P, s.open))
+	return Result{XP: s.best, Upper: upper, Optimal: upper <= s.best.P, Stats: s.stats}
+}
+
+// UpperBound returns an upper bound of the MAP value of spn: for every
+// variable, the MAP value is at most the largest marginal of its states.
+func UpperBound(ctx context.Context, spn SPN) float64 {
+	w := NewWorkspace(spn)
+	return upperBound(ctx, w, w.free())
+}
+
+// upperBound returns the tightest of the per-variable bounds of the
+// assignments that extend as, or +Inf if ctx is done first.
+func upperBound(ctx context.Context, w *Workspace, as [][]float64) float64 {
+	d := w.matrix()
+	defer w.release(d)
+	if !w.Derivative(ctx, as, d) {
+		return math.Inf(1)
+	}
+	bound := math.Inf(1)
+	for i := range as {
+		m := math.Inf(-1)
+		for j := range as[i] {
+			if as[i][j] != 0 {
+				m = math.Max(m, d[i][j])
+			}
+		}
+		bound = math.Min(bound, m)
+	}
+	return bound
+}
+
+func ExactMP(ctx context.Context, spn SPN, baseline float64) float64 {
+	return exactMP(ctx, spn, baseline).P
+}
+
+func exactMP(ctx context.Context, spn SPN, baseline float64) Result {
+	w := NewWorkspace(spn)
+	s := newSearch(ctx, w, w.free(), baseline)
+	s.dfsMP(w, make([]int, len(spn.Schema)), 0, s.upper)
+	return s.result()
+}
+
+func (s *search) dfsMP(w *Workspace, x []int, xi int, bound float64) {
+	if s.done() {
+		s.interrupt(bound)
+		return
+	}
+	s.stats.Expanded++
+
+	if xi == len(x) {
+		s.stats.Evals++
+		s.update(x, w.evalPrefix(x, xi))
+		return
+	}
+	for v := 0; v < w.f.Schema[xi]; v++ {
+		x[xi] = v
+		s.stats.Evals++
+		if p := w.evalPrefix(x, xi+1); p > s.best.P {
+			s.dfsMP(w, x, xi+1, p)
+		} else {
+			s.stats.Pruned++
+		}
+	}
+}
+
+func ExactFC(ctx context.Context, spn SPN, baseline float64) float64 {
+	return exactFC(ctx, spn, baseline).P
+}
+
+func exactFC(ctx context.Context, spn SPN, baseline float64) Result {
+	x := make([]int, len(spn.Schema))
+	for i := range x {
+		x[i] = -1
+	}
+	w := NewWorkspace(spn)
+	s := newSearch(ctx, w, w.assignment(x), baseline)
+	s.dfsFC(w, x, s.upper)
+	return s.result()
+}
+
+// forwardCheckingX prunes the values of the free variables of x that cannot
+// beat the incumbent, fixing the variables left with a single value. It
+// stores the pruned assignment in as and its derivatives in d, and returns
+// false if the subtree can be pruned; canceled then reports whether the
+// search is done, which leaves d undefined.
+func (s *search) forwardCheckingX(w *Workspace, x []int, as, d [][]float64) (ok, canceled bool) {
+	fillAssignment(as, x)
+	for {
+		if !s.derivative(w, as, d) {
+			return false, true
+		}
+		updated, ok := forwardCheckingStep(x, as, d, s.best.P)
+		if !ok {
+			s.stats.Pruned++
+			return false, false
+		}
+		if !updated {
+			return true, false
+		}
+	}
+}
+
+// leaf records the complete assignment x. The derivatives d[0] hold the
+// values of x with its first variable set to each state.
+func (s *search) leaf(x []int, d [][]float64) {
+	for j := range d[0] {
+		if d[0][x[0]] < d[0][j] {
+			x[0] = j
+		}
+	}
+	s.update(x, d[0][x[0]])
+}
+
+func (s *search) dfsFC(w *Workspace, x []int, bound float64) {
+	if s.done() {
+		s.interrupt(bound)
+		return
+	}
+	s.stats.Expanded++
+
+	x2, as, d := w.vars(), w.matrix(), w.matrix()
+	defer w.releaseVars(x2)
+	defer w.release(as)
+	defer w.release(d)
+	copy(x2, x)
+	x = x2
+	ok, canceled := s.forwardCheckingX(w, x, as, d)
+	if !ok {
+		if canceled {
+			s.interrupt(bound)
+		}
+		return
+	}
 	for i := range x {
 		if x[i] == -1 {
-			var valI int
-			if d[i][0] < d[i][1] {
-				valI = 1
-			} else {
-				valI = 0
+			for v, a := range as[i] {
+				if a != 0 {
+					x[i] = v
+					s.dfsFC(w, x, d[i][v])
+				}
 			}
-			if varID == -1 || d[varID][valID] < d[i][valI] {
-				varID = i
-				valID = valI
+			return
+		}
+	}
+	s.leaf(x, d)
+}
+
+func ExactORDERING(ctx context.Context, spn SPN, baseline float64) float64 {
+	return exactORDERING(ctx, spn, baseline).P
+}
+
+func exactORDERING(ctx context.Context, spn SPN, baseline float64) Result {
+	x := make([]int, len(spn.Schema))
+	for i := range x {
+		x[i] = -1
+	}
+	w := NewWorkspace(spn)
+	s := newSearch(ctx, w, w.assignment(x), baseline)
+	s.dfsORDERING(w, x, s.upper)
+	return s.result()
+}
+
+func (s *search) dfsORDERING(w *Workspace, x []int, bound float64) {
+	if s.done() {
+		s.interrupt(bound)
+		return
+	}
+	s.stats.Expanded++
+
+	x2, vs, as, d := w.vars(), w.vars(), w.matrix(), w.matrix()
+	defer w.releaseVars(x2)
+	defer w.releaseVars(vs)
+	defer w.release(as)
+	defer w.release(d)
+	copy(x2, x)
+	x = x2
+	ok, canceled := s.forwardCheckingX(w, x, as, d)
+	if !ok {
+		if canceled {
+			s.interrupt(bound)
+		}
+		return
+	}
+	if i, vs := orderX(x, as, d, vs); i != -1 {
+		for _, v := range vs {
+			x[i] = v
+			s.dfsORDERING(w, x, d[i][v])
+		}
+		return
+	}
+	s.leaf(x, d)
+}
+
+func ExactSTAGE(ctx context.Context, spn SPN, x []int, best float64) float64 {
+	return exactSTAGE(ctx, spn, x, best).P
+}
+
+func exactSTAGE(ctx context.Context, spn SPN, x []int, best float64) Result {
+	vars := make([]int, len(x))
+	for i := range vars {
+		vars[i] = i
+	}
+	w := NewWorkspace(spn)
+	s := newSearch(ctx, w, w.assignment(x), best)
+	s.stage(w, x, vars, make([]int, len(x)), s.upper)
+	return s.result()
+}
+
+// stage searches the staged network of w, whose i-th variable is the
+// vars[i]-th original one. full holds the original variables fixed by earlier
+// stages. Staging builds the reduced network of the next stage and a new
+// workspace for it, whose buffers each stage allocates afresh; within a stage
+// the search reuses them.
+func (s *search) stage(w *Workspace, x []int, vars []int, full []int, bound float64) {
+	if s.done() {
+		s.interrupt(bound)
+		return
+	}
+	s.stats.Expanded++
+
+	x2, vs, as, d := w.vars(), w.vars(), w.matrix(), w.matrix()
+	defer w.releaseVars(x2)
+	defer w.releaseVars(vs)
+	defer w.release(as)
+	defer w.release(d)
+	copy(x2, x)
+	x = x2
+	for {
+		fillAssignment(as, x)
+		if !s.derivative(w, as, d) {
+			s.interrupt(bound)
+			return
+		}
+		updated, ok := fixX(x, d, s.best.P)
+		if !ok {
+			s.stats.Pruned++
+			return
+		}
+		if !updated {
+			break
+		}
+	}
+	cnt := 0
+	for i := range x {
+		if x[i] == -1 {
+			cnt++
+		}
+	}
+	if cnt > 1 && len(x)-cnt >= 5 {
+		full2 := make([]int, len(full))
+		copy(full2, full)
+		full = full2
+		vars2 := make([]int, 0, cnt)
+		for i := range x {
+			if x[i] == -1 {
+				vars2 = append(vars2, vars[i])
+			} else {
+				full[vars[i]] = x[i]
 			}
 		}
+		vars = vars2
+		staged, ok := reduce(s.ctx, w.SPN().StageSPN(x))
+		if !ok {
+			s.interrupt(bound)
+			return
+		}
+		w = NewWorkspace(staged)
+		x, vs, d = w.vars(), w.vars(), w.matrix()
+		for i := range x {
+			x[i] = -1
+		}
+		if !s.derivative(w, w.free(), d) {
+			s.interrupt(bound)
+			return
+		}
 	}
+	varID, valIDs := pickX(x, d, s.best.P, vs)
 	if varID == -1 {
-		return math.Max(best, d[0][x[0]])
+		s.stageUpdate(x, vars, full, d[0][x[0]])
+		return
 	}
 	if cnt == 1 {
-		return d[varID][valID]
+		x[varID] = valIDs[0]
+		s.stageUpdate(x, vars, full, d[varID][valIDs[0]])
+		return
+	}
+	for _, valID := range valIDs {
+		x[varID] = valID
+		s.stage(w, x, vars, full, d[varID][valID])
+	}
+}
+
+func (s *search) stageUpdate(x []int, vars []int, full []int, p float64) {
+	if s.best.P < p {
+		y := make([]int, len(full))
+		copy(y, full)
+		for i, v := range vars {
+			y[v] = x[i]
+		}
+		s.best = XP{y, p}
+		s.progress.report(s.best, s.upper)
 	}
-	x[varID] = valID
-	best = ExactFastStage(spn, x, best, fastStaged)
-	x[varID] = 1 - valID
-	best = ExactFastStage(spn, x, best, fastStaged)
-	return best
 }
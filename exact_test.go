@@ -0,0 +1,72 @@
+package maxspn
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestExactMultiValued(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	for times := 0; times < 5; times++ {
+		schema := make([]int, 9)
+		for i := range schema {
+			schema[i] = 2 + r.Intn(2)
+		}
+		schema[r.Intn(len(schema))] = 5
+		spn := randomSPN(r, schema)
+		all := make(Query, len(schema))
+		for i := range all {
+			all[i] = QueryVar
+		}
+		want := bruteForceMAP(spn, all).P
+		free := func() []int {
+			x := make([]int, len(schema))
+			for i := range x {
+				x[i] = -1
+			}
+			return x
+		}
+		ctx := context.Background()
+		got := map[string]float64{
+			"ExactOrder":     ExactOrder(ctx, spn, math.Inf(-1)),
+			"ExactOrderDer":  ExactOrderDer(ctx, spn, math.Inf(-1)),
+			"Exact":          Exact(ctx, spn, math.Inf(-1)),
+			"ExactSolver":    ExactSolver(ctx, spn),
+			"ExactSolverBin": ExactSolverBin(ctx, spn),
+			"ExactStage":     ExactStage(ctx, spn, free(), math.Inf(-1)),
+			"ExactFastStage": ExactFastStage(ctx, spn, free(), math.Inf(-1), 0),
+		}
+		for name, p := range got {
+			if math.Abs(p-want) > 1e-9 {
+				t.Errorf("%s: got %f, want %f", name, p, want)
+			}
+		}
+
+		q := make(Query, len(schema))
+		for i := range q {
+			switch r.Intn(4) {
+			case 0:
+				q[i] = HiddenVar
+			case 1:
+				q[i] = r.Intn(schema[i])
+			default:
+				q[i] = QueryVar
+			}
+		}
+		q[0] = QueryVar
+		wantQ := bruteForceMAP(spn, q)
+		for name, m := range map[string]Method{
+			"MP": MP(), "FC": FC(), "ORDERING": ORDERING(), "STAGE": STAGE(), "EXACT": EXACT(),
+		} {
+			res, err := m.Solve(ctx, spn, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(res.P-wantQ.P) > 1e-9 || math.Abs(spn.EvalX(res.X)-wantQ.P) > 1e-9 {
+				t.Errorf("%s %s: got %v %f, want %v %f", name, q, res.X, res.P, wantQ.X, wantQ.P)
+			}
+		}
+	}
+}
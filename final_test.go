@@ -1,7 +0,0 @@
-package main
-
-import "testing"
-
-func TestGenerateQEH(t *testing.T) {
-	GenerateQEH()
-}
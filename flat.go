@@ -0,0 +1,401 @@
+package maxspn
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"runtime"
+	"sync"
+)
+
+// Node kinds of a Flat.
+const (
+	FlatTrm uint8 = iota
+	FlatSum
+	FlatPrd
+	FlatNum // a constant of an AC
+)
+
+// Flat is an immutable compiled form of an SPN or AC: the nodes in
+// topological order in contiguous slices, without interfaces or pointers. The
+// children of node i are Child[Start[i]:Start[i+1]], with the log-weights
+// Weight at the same offsets (0 for product edges). Its kernels compute the
+// same values as the corresponding functions on the SPN.
+type Flat struct {
+	Schema []int
+	Kind   []uint8
+	Kth    []int32 // variable of a terminal
+	Value  []int32 // value of a terminal
+	Start  []int32 // len(Kind)+1 child offsets
+	Child  []int32
+	Weight []float64
+	Num    []float64 // log-value of a constant; nil without constants
+}
+
+// Flatten compiles spn, whose nodes must be in topological order.
+func (spn SPN) Flatten() *Flat {
+	nn := len(spn.Nodes)
+	edges := 0
+	for _, n := range spn.Nodes {
+		switch n := n.(type) {
+		case *Sum:
+			edges += len(n.Edges)
+		case *Prd:
+			edges += len(n.Edges)
+		}
+	}
+	f := &Flat{
+		Schema: spn.Schema,
+		Kind:   make([]uint8, nn),
+		Kth:    make([]int32, nn),
+		Value:  make([]int32, nn),
+		Start:  make([]int32, nn+1),
+		Child:  make([]int32, 0, edges),
+		Weight: make([]float64, 0, edges),
+	}
+	for i, n := range spn.Nodes {
+		switch n := n.(type) {
+		case *Trm:
+			f.Kind[i] = FlatTrm
+			f.Kth[i], f.Value[i] = int32(n.Kth), int32(n.Value)
+		case *Sum:
+			f.Kind[i] = FlatSum
+			for _, e := range n.Edges {
+				f.Child = append(f.Child, int32(e.Node.ID()))
+				f.Weight = append(f.Weight, e.Weight)
+			}
+		case *Prd:
+			f.Kind[i] = FlatPrd
+			for _, e := range n.Edges {
+				f.Child = append(f.Child, int32(e.Node.ID()))
+				f.Weight = append(f.Weight, 0)
+			}
+		}
+		f.Start[i+1] = int32(len(f.Child))
+	}
+	return f
+}
+
+// Flatten compiles ac, whose nodes must be in topological order, keeping its
+// node IDs. Sums have weight 0 edges and constants are FlatNum nodes.
+func (ac AC) Flatten() *Flat {
+	nn := len(ac.Nodes)
+	f := &Flat{
+		Schema: ac.Schema,
+		Kind:   make([]uint8, nn),
+		Kth:    make([]int32, nn),
+		Value:  make([]int32, nn),
+		Start:  make([]int32, nn+1),
+	}
+	for i, n := range ac.Nodes {
+		switch n := n.(type) {
+		case VarNode:
+			f.Kind[i] = FlatTrm
+			f.Kth[i], f.Value[i] = int32(n.Kth), int32(n.Value)
+		case NumNode:
+			if f.Num == nil {
+				f.Num = make([]float64, nn)
+			}
+			f.Kind[i] = FlatNum
+			f.Num[i] = math.Log(float64(n))
+		case MulNode:
+			f.Kind[i] = FlatPrd
+			for _, c := range n {
+				f.Child = append(f.Child, int32(c))
+				f.Weight = append(f.Weight, 0)
+			}
+		case AddNode:
+			f.Kind[i] = FlatSum
+			for _, c := range n {
+				f.Child = append(f.Child, int32(c))
+				f.Weight = append(f.Weight, 0)
+			}
+		}
+		f.Start[i+1] = int32(len(f.Child))
+	}
+	return f
+}
+
+// Len returns the number of nodes.
+func (f *Flat) Len() int {
+	return len(f.Kind)
+}
+
+// Eval is SPN.Eval.
+func (f *Flat) Eval(ass [][]float64) []float64 {
+	return f.evalContext(context.Background(), ass, make([]float64, f.Len()))
+}
+
+// EvalX is SPN.EvalX.
+func (f *Flat) EvalX(x []int) float64 {
+	val := f.Eval(X2Ass(x, f.Schema))
+	return val[len(val)-1]
+}
+
+// evalContext is Eval into val that returns nil if ctx is done before the
+// pass ends.
+func (f *Flat) evalContext(ctx context.Context, ass [][]float64, val []float64) []float64 {
+	for i, kind := range f.Kind {
+		if canceled(ctx, i) {
+			return nil
+		}
+		cs, ws := f.Child[f.Start[i]:f.Start[i+1]], f.Weight[f.Start[i]:f.Start[i+1]]
+		switch kind {
+		case FlatTrm:
+			val[i] = math.Log(ass[f.Kth[i]][f.Value[i]])
+		case FlatNum:
+			val[i] = f.Num[i]
+		case FlatSum:
+			val[i] = logSumExpF(len(cs), func(k int) float64 {
+				return ws[k] + val[cs[k]]
+			})
+		case FlatPrd:
+			prd := 0.0
+			for _, c := range cs {
+				prd += val[c]
+			}
+			val[i] = prd
+		}
+	}
+	return val
+}
+
+// EvalAt is evalAt: the log-value of node at under the complete assignment
+// x, evaluating only the nodes up to at.
+func (f *Flat) EvalAt(x []int, at int) float64 {
+	val := make([]float64, at+1)
+	for i := 0; i <= at; i++ {
+		cs, ws := f.Child[f.Start[i]:f.Start[i+1]], f.Weight[f.Start[i]:f.Start[i+1]]
+		switch f.Kind[i] {
+		case FlatTrm:
+			val[i] = math.Inf(-1)
+			if x[f.Kth[i]] == int(f.Value[i]) {
+				val[i] = 0
+			}
+		case FlatNum:
+			val[i] = f.Num[i]
+		case FlatSum:
+			val[i] = logSumExpF(len(cs), func(k int) float64 {
+				return ws[k] + val[cs[k]]
+			})
+		case FlatPrd:
+			prd := 0.0
+			for _, c := range cs {
+				prd += val[c]
+			}
+			val[i] = prd
+		}
+	}
+	return val[at]
+}
+
+// Derivative is DerivativeS: the log-derivatives of the root with respect to
+// every node.
+func (f *Flat) Derivative(ass [][]float64) []float64 {
+	dv := f.NewDerivatives()
+	f.Differentiate(context.Background(), ass, dv)
+	return dv.Node
+}
+
+// MaxMax is MaxMax.
+func (f *Flat) MaxMax() []int {
+	prt := make([]float64, f.Len())
+	branch := make([]int32, f.Len())
+	for i, kind := range f.Kind {
+		cs, ws := f.Child[f.Start[i]:f.Start[i+1]], f.Weight[f.Start[i]:f.Start[i+1]]
+		switch kind {
+		case FlatTrm:
+			prt[i] = 0
+		case FlatNum:
+			prt[i] = f.Num[i]
+		case FlatSum:
+			eBest, pBest := int32(-1), math.Inf(-1)
+			for k, c := range cs {
+				if crt := ws[k] + prt[c]; pBest < crt {
+					pBest, eBest = crt, c
+				}
+			}
+			branch[i] = eBest
+			prt[i] = pBest
+		case FlatPrd:
+			val := 0.0
+			for _, c := range cs {
+				val += prt[c]
+			}
+			prt[i] = val
+		}
+	}
+	return f.descend(func(i int) int32 { return branch[i] })
+}
+
+// descend returns the assignment of the induced tree that takes, at every
+// reached sum node i, the child pick(i).
+func (f *Flat) descend(pick func(i int) int32) []int {
+	x := make([]int, len(f.Schema))
+	reach := make([]bool, f.Len())
+	reach[len(reach)-1] = true
+	for i := len(f.Kind) - 1; i >= 0; i-- {
+		if !reach[i] {
+			continue
+		}
+		switch f.Kind[i] {
+		case FlatTrm:
+			x[f.Kth[i]] = int(f.Value[i])
+		case FlatSum:
+			if c := pick(i); c >= 0 {
+				reach[c] = true
+			}
+		case FlatPrd:
+			for _, c := range f.Child[f.Start[i]:f.Start[i+1]] {
+				reach[c] = true
+			}
+		}
+	}
+	return x
+}
+
+// Partition is partition: the log-values of the nodes with every variable
+// summed out.
+func (f *Flat) Partition() []float64 {
+	return f.Eval(freeAssignment(f.Schema))
+}
+
+// Sample is prb1: it draws a complete assignment from the distribution of
+// the network, given its Partition prt.
+func (f *Flat) Sample(prt []float64, r *rand.Rand) []int {
+	return f.descend(func(i int) int32 {
+		cs, ws := f.Child[f.Start[i]:f.Start[i+1]], f.Weight[f.Start[i]:f.Start[i+1]]
+		u := math.Log(r.Float64()) + prt[i]
+		crt := math.Inf(-1)
+		for k, c := range cs {
+			crt = LogSumExp(crt, ws[k]+prt[c])
+			if u < crt {
+				return c
+			}
+		}
+		return -1
+	})
+}
+
+// batchBlock is the number of assignments that a batched pass evaluates
+// together, node by node.
+const batchBlock = 64
+
+// EvalXBatch returns the log-values EvalX of the assignments xs, in which
+// x[i] == -1 leaves variable i free. It sweeps the nodes once per block of
+// batchBlock assignments, reusing one buffer.
+func (f *Flat) EvalXBatch(xs [][]int) []float64 {
+	ps := make([]float64, len(xs))
+	f.evalXBatch(xs, ps, f.batchBuf(len(xs)))
+	return ps
+}
+
+// EvalXBatchParallel is EvalXBatch that splits xs across at most workers
+// goroutines, or GOMAXPROCS goroutines if workers is not positive.
+func (f *Flat) EvalXBatchParallel(xs [][]int, workers int) []float64 {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	chunk := (len(xs) + workers - 1) / workers
+	if chunk < batchBlock {
+		chunk = batchBlock
+	}
+	ps := make([]float64, len(xs))
+	wg := sync.WaitGroup{}
+	for lo := 0; lo < len(xs); lo += chunk {
+		hi := lo + chunk
+		if hi > len(xs) {
+			hi = len(xs)
+		}
+		wg.Add(1)
+		go func(lo, hi int) {
+			f.evalXBatch(xs[lo:hi], ps[lo:hi], f.batchBuf(hi-lo))
+			wg.Done()
+		}(lo, hi)
+	}
+	wg.Wait()
+	return ps
+}
+
+// batchBuf returns a buffer for evalXBatch over n assignments, its blocks
+// batchBlock wide or narrower when n is smaller.
+func (f *Flat) batchBuf(n int) []float64 {
+	if n > batchBlock {
+		n = batchBlock
+	}
+	return make([]float64, n*(f.Len()+2))
+}
+
+// evalXBatch stores the log-values of xs in ps, using buf of
+// width*(f.Len()+2) values: the node values, row i holding node i, and two
+// scratch rows, each width values wide. It evaluates width assignments per
+// pass. Sums accumulate as in logSumExpF, so the values equal those of EvalX.
+func (f *Flat) evalXBatch(xs [][]int, ps []float64, buf []float64) {
+	nn := f.Len()
+	width := len(buf) / (nn + 2)
+	if len(xs) == 0 || width == 0 {
+		return
+	}
+	val, max, sum := buf[:width*nn], buf[width*nn:width*(nn+1)], buf[width*(nn+1):]
+	row := func(i int32, b int) []float64 {
+		return val[int(i)*width : int(i)*width+b]
+	}
+	for lo := 0; lo < len(xs); lo += width {
+		block := xs[lo:]
+		if len(block) > width {
+			block = block[:width]
+		}
+		b := len(block)
+		for i, kind := range f.Kind {
+			v := row(int32(i), b)
+			cs, ws := f.Child[f.Start[i]:f.Start[i+1]], f.Weight[f.Start[i]:f.Start[i+1]]
+			switch kind {
+			case FlatTrm:
+				k, value := f.Kth[i], int(f.Value[i])
+				for j, x := range block {
+					v[j] = math.Inf(-1)
+					if x[k] == -1 || x[k] == value {
+						v[j] = 0
+					}
+				}
+			case FlatNum:
+				for j := range v {
+					v[j] = f.Num[i]
+				}
+			case FlatSum:
+				max, sum := max[:b], sum[:b]
+				for j := range max {
+					max[j], sum[j] = math.Inf(-1), 0
+				}
+				for k, c := range cs {
+					for j, cv := range row(c, b) {
+						max[j] = math.Max(max[j], ws[k]+cv)
+					}
+				}
+				for k, c := range cs {
+					for j, cv := range row(c, b) {
+						if !math.IsInf(max[j], 0) {
+							sum[j] += math.Exp(ws[k] + cv - max[j])
+						}
+					}
+				}
+				for j := range v {
+					v[j] = max[j]
+					if !math.IsInf(max[j], 0) {
+						v[j] = math.Log(sum[j]) + max[j]
+					}
+				}
+			case FlatPrd:
+				for j := range v {
+					v[j] = 0
+				}
+				for _, c := range cs {
+					for j, cv := range row(c, b) {
+						v[j] += cv
+					}
+				}
+			}
+		}
+		copy(ps[lo:], row(int32(nn-1), b))
+	}
+}
@@ -0,0 +1,100 @@
+package maxspn
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func sameFloats(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] && !(math.IsNaN(a[i]) && math.IsNaN(b[i])) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestFlat(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	schema := []int{2, 3, 2, 4, 2, 2, 3, 2}
+	for times := 0; times < 10; times++ {
+		spn := randomSPN(r, schema)
+		if times%2 == 1 {
+			// Evidence adds zero terminals, and so zero product children.
+			spn = spn.StageSPN(Query{-1, 2, -1, -1, 0, -1, -1, -1})
+		}
+		f := spn.Flatten()
+		if f.Len() != len(spn.Nodes) {
+			t.Fatalf("Len = %d, want %d", f.Len(), len(spn.Nodes))
+		}
+		for k := 0; k < 10; k++ {
+			x := make([]int, len(spn.Schema))
+			for i := range x {
+				x[i] = r.Intn(spn.Schema[i]+1) - 1
+			}
+			as := X2Ass(x, spn.Schema)
+			if got, want := f.Eval(as), spn.Eval(as); !sameFloats(got, want) {
+				t.Errorf("Eval(%v) = %v, want %v", x, got, want)
+			}
+			if got, want := f.Derivative(as), DerivativeS(spn, as); !sameFloats(got, want) {
+				t.Errorf("Derivative(%v) = %v, want %v", x, got, want)
+			}
+			for i := range x {
+				if x[i] == -1 {
+					x[i] = 0
+				}
+			}
+			at := r.Intn(len(spn.Nodes))
+			if got, want := f.EvalAt(x, at), evalAt(spn, x, at); got != want {
+				t.Errorf("EvalAt(%v, %d) = %v, want %v", x, at, got, want)
+			}
+		}
+		if got, want := f.MaxMax(), MaxMax(spn); !reflect.DeepEqual(got, want) {
+			t.Errorf("MaxMax = %v, want %v", got, want)
+		}
+		prt := f.Partition()
+		if want := partition(spn); !sameFloats(prt, want) {
+			t.Errorf("Partition = %v, want %v", prt, want)
+		}
+		seed := r.Int63()
+		fr, sr := rand.New(rand.NewSource(seed)), rand.New(rand.NewSource(seed))
+		for k := 0; k < 10; k++ {
+			if got, want := f.Sample(prt, fr), prb1(spn, prt, sr); !reflect.DeepEqual(got, want) {
+				t.Errorf("Sample = %v, want %v", got, want)
+			}
+		}
+	}
+}
+
+func TestFlat_EvalXBatch(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	schema := []int{2, 3, 2, 4, 2, 2, 3, 2}
+	for times := 0; times < 5; times++ {
+		spn := randomSPN(r, schema)
+		f := spn.Flatten()
+		for _, n := range []int{0, 1, 5, batchBlock, 2*batchBlock + 3} {
+			xs := make([][]int, n)
+			want := make([]float64, n)
+			for k := range xs {
+				xs[k] = make([]int, len(schema))
+				for i := range xs[k] {
+					xs[k][i] = r.Intn(schema[i]+1) - 1
+				}
+				want[k] = spn.EvalX(xs[k])
+			}
+			if got := f.EvalXBatch(xs); !sameFloats(got, want) {
+				t.Errorf("EvalXBatch of %d = %v, want %v", n, got, want)
+			}
+			for _, workers := range []int{0, 1, 3} {
+				if got := f.EvalXBatchParallel(xs, workers); !sameFloats(got, want) {
+					t.Errorf("EvalXBatchParallel of %d on %d workers = %v, want %v", n, workers, got, want)
+				}
+			}
+		}
+	}
+}
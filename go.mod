@@ -0,0 +1,3 @@
+module github.com/meijun/maxspn
+
+go 1.19
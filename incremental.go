@@ -0,0 +1,216 @@
+package maxspn
+
+import (
+	"container/heap"
+	"context"
+	"math"
+)
+
+// Incremental holds an assignment of a Flat network and the log-values of
+// its nodes, and re-evaluates after a variable changes by propagating only
+// along the ancestors of the terminals whose value changed. It is not safe
+// for concurrent use.
+type Incremental struct {
+	f       *Flat
+	pStart  []int32 // parents of node i are parent[pStart[i]:pStart[i+1]]
+	parent  []int32
+	trms    [][]int32 // terminals of every variable
+	x       []int
+	val     []float64
+	queue   nodeQueue
+	queued  []bool
+	changes []change // undo log
+	frames  []int    // start in changes of every flip not undone
+}
+
+type change struct {
+	node int32 // -1 for the variable change of a flip
+	old  float64
+	kth  int
+	xold int
+}
+
+// NewIncremental evaluates f at x, in which x[i] == -1 leaves variable i
+// free, and returns the evaluator holding a copy of x.
+func NewIncremental(f *Flat, x []int) *Incremental {
+	nn := f.Len()
+	inc := &Incremental{
+		f:      f,
+		pStart: make([]int32, nn+1),
+		parent: make([]int32, len(f.Child)),
+		trms:   make([][]int32, len(f.Schema)),
+		x:      append([]int(nil), x...),
+		queued: make([]bool, nn),
+	}
+	for _, c := range f.Child {
+		inc.pStart[c+1]++
+	}
+	for i := 0; i < nn; i++ {
+		inc.pStart[i+1] += inc.pStart[i]
+	}
+	next := append([]int32(nil), inc.pStart[:nn]...)
+	for i := 0; i < nn; i++ {
+		for _, c := range f.Child[f.Start[i]:f.Start[i+1]] {
+			inc.parent[next[c]] = int32(i)
+			next[c]++
+		}
+		if f.Kind[i] == FlatTrm {
+			inc.trms[f.Kth[i]] = append(inc.trms[f.Kth[i]], int32(i))
+		}
+	}
+	inc.val = f.evalContext(context.Background(), X2Ass(x, f.Schema), make([]float64, nn))
+	return inc
+}
+
+// P returns the log-value of the root at the current assignment.
+func (inc *Incremental) P() float64 {
+	return inc.val[len(inc.val)-1]
+}
+
+// X returns a copy of the current assignment.
+func (inc *Incremental) X() []int {
+	return append([]int(nil), inc.x...)
+}
+
+// Value returns the current value of variable kth.
+func (inc *Incremental) Value(kth int) int {
+	return inc.x[kth]
+}
+
+// Flip sets variable kth to value, or frees it if value is -1, and returns
+// the new log-value of the root. Undo reverts it.
+func (inc *Incremental) Flip(kth, value int) float64 {
+	inc.frames = append(inc.frames, len(inc.changes))
+	inc.changes = append(inc.changes, change{node: -1, kth: kth, xold: inc.x[kth]})
+	inc.x[kth] = value
+	for _, t := range inc.trms[kth] {
+		v := math.Inf(-1)
+		if value == -1 || value == int(inc.f.Value[t]) {
+			v = 0
+		}
+		if v != inc.val[t] {
+			inc.set(t, v)
+		}
+	}
+	for inc.queue.Len() > 0 {
+		i := heap.Pop(&inc.queue).(int32)
+		inc.queued[i] = false
+		if v := inc.eval(i); v != inc.val[i] {
+			inc.set(i, v)
+		}
+	}
+	return inc.P()
+}
+
+// set changes the value of node i and queues its parents.
+func (inc *Incremental) set(i int32, v float64) {
+	inc.changes = append(inc.changes, change{node: i, old: inc.val[i]})
+	inc.val[i] = v
+	for _, p := range inc.parent[inc.pStart[i]:inc.pStart[i+1]] {
+		if !inc.queued[p] {
+			inc.queued[p] = true
+			heap.Push(&inc.queue, p)
+		}
+	}
+}
+
+// eval computes the value of the inner node i from its children, as Eval.
+func (inc *Incremental) eval(i int32) float64 {
+	f := inc.f
+	cs, ws := f.Child[f.Start[i]:f.Start[i+1]], f.Weight[f.Start[i]:f.Start[i+1]]
+	if f.Kind[i] == FlatSum {
+		return logSumExpF(len(cs), func(k int) float64 {
+			return ws[k] + inc.val[cs[k]]
+		})
+	}
+	prd := 0.0
+	for _, c := range cs {
+		prd += inc.val[c]
+	}
+	return prd
+}
+
+// Undo reverts the last flip that is not undone or committed. It reports
+// whether there was one.
+func (inc *Incremental) Undo() bool {
+	if len(inc.frames) == 0 {
+		return false
+	}
+	start := inc.frames[len(inc.frames)-1]
+	inc.frames = inc.frames[:len(inc.frames)-1]
+	for k := len(inc.changes) - 1; k >= start; k-- {
+		c := inc.changes[k]
+		if c.node == -1 {
+			inc.x[c.kth] = c.xold
+		} else {
+			inc.val[c.node] = c.old
+		}
+	}
+	inc.changes = inc.changes[:start]
+	return true
+}
+
+// Set moves to the assignment x by flips of the variables that differ, and
+// commits them. It returns the new log-value of the root.
+func (inc *Incremental) Set(x []int) float64 {
+	for k, v := range x {
+		if inc.x[k] != v {
+			inc.Flip(k, v)
+		}
+	}
+	inc.Commit()
+	return inc.P()
+}
+
+// Commit forgets the flips so far, which can no longer be undone.
+func (inc *Incremental) Commit() {
+	inc.changes = inc.changes[:0]
+	inc.frames = inc.frames[:0]
+}
+
+// nodeQueue is a min-heap of node IDs, so that a node is re-evaluated after
+// all its changed children.
+type nodeQueue []int32
+
+func (q nodeQueue) Len() int            { return len(q) }
+func (q nodeQueue) Less(i, j int) bool  { return q[i] < q[j] }
+func (q nodeQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *nodeQueue) Push(x interface{}) { *q = append(*q, x.(int32)) }
+func (q *nodeQueue) Pop() interface{} {
+	old := *q
+	x := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return x
+}
+
+// HillClimb improves the complete assignment x by steepest ascent over
+// single-variable changes until no change improves it or ctx is done, and
+// returns the local maximum.
+func HillClimb(ctx context.Context, spn SPN, x []int) XP {
+	inc := NewIncremental(spn.Flatten(), x)
+	best := XP{inc.X(), inc.P()}
+	report(ctx, best, math.Inf(1))
+	for ctx.Err() == nil {
+		bk, bv, bp := -1, -1, inc.P()
+		for k, card := range spn.Schema {
+			cur := inc.Value(k)
+			for v := 0; v < card; v++ {
+				if v == cur {
+					continue
+				}
+				if p := inc.Flip(k, v); p > bp {
+					bk, bv, bp = k, v, p
+				}
+				inc.Undo()
+			}
+		}
+		if bk == -1 {
+			break
+		}
+		inc.Flip(bk, bv)
+		inc.Commit()
+		best = XP{inc.X(), inc.P()}
+		report(ctx, best, math.Inf(1))
+	}
+	return best
+}
@@ -0,0 +1,92 @@
+package maxspn
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestIncremental(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	schema := []int{2, 3, 2, 4, 2, 2, 3, 2}
+	for times := 0; times < 5; times++ {
+		spn := randomSPN(r, schema)
+		x := make([]int, len(schema))
+		for i := range x {
+			x[i] = r.Intn(schema[i])
+		}
+		inc := NewIncremental(spn.Flatten(), x)
+		if got, want := inc.P(), spn.EvalX(x); got != want {
+			t.Fatalf("P = %v, want %v", got, want)
+		}
+		var history [][]int
+		for k := 0; k < 30; k++ {
+			if len(history) > 0 && r.Intn(3) == 0 {
+				inc.Undo()
+				x, history = history[len(history)-1], history[:len(history)-1]
+			} else {
+				history = append(history, append([]int(nil), x...))
+				i := r.Intn(len(schema))
+				x[i] = r.Intn(schema[i]+1) - 1
+				inc.Flip(i, x[i])
+			}
+			if !reflect.DeepEqual(inc.X(), x) {
+				t.Fatalf("X = %v, want %v", inc.X(), x)
+			}
+			want := spn.Eval(X2Ass(x, schema))
+			if !sameFloats(inc.val, want) {
+				t.Fatalf("values after %d steps at %v: %v, want %v", k, x, inc.val, want)
+			}
+		}
+		inc.Commit()
+		if inc.Undo() {
+			t.Error("Undo after Commit succeeded")
+		}
+	}
+}
+
+func TestHillClimb(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	schema := []int{2, 3, 2, 4, 2, 2, 3, 2}
+	for times := 0; times < 5; times++ {
+		spn := randomSPN(r, schema)
+		x := make([]int, len(schema))
+		res := HillClimb(context.Background(), spn, x)
+		if p := spn.EvalX(res.X); p != res.P || p < spn.EvalX(x) {
+			t.Errorf("HillClimb = %v, EvalX %v, start %v", res, p, spn.EvalX(x))
+		}
+		ch := make(chan []XP, 1)
+		inc := NewIncremental(spn.Flatten(), res.X)
+		nextGen(res, inc, ch)
+		if better := <-ch; len(better) > 0 {
+			t.Errorf("HillClimb %v is not a local maximum: %v", res, better)
+		}
+
+		// The incremental neighbours, from the evaluator moved to x, are those
+		// of the derivative pass.
+		xp := XP{x, spn.EvalX(x)}
+		nextGen(xp, inc, ch)
+		got := <-ch
+		if inc.P() != xp.P {
+			t.Errorf("evaluator left at %v, want %v", inc.P(), xp.P)
+		}
+		f := spn.Flatten()
+		nextGenD(xp, f, f.NewDerivatives(), ch)
+		want := <-ch
+		ps := map[string]float64{}
+		for _, xp := range want {
+			ps[fmt.Sprint(xp.X)] = xp.P
+		}
+		if len(got) != len(want) {
+			t.Fatalf("nextGen %v, nextGenD %v", got, want)
+		}
+		for _, xp := range got {
+			if p, ok := ps[fmt.Sprint(xp.X)]; !ok || math.Abs(p-xp.P) > 1e-9 {
+				t.Errorf("nextGen %v, nextGenD %v", got, want)
+			}
+		}
+	}
+}
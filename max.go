@@ -1,7 +1,8 @@
-package main
+package maxspn
 
 import (
 	"container/heap"
+	"context"
 	"log"
 	"math"
 	"math/rand"
@@ -14,8 +15,8 @@ type XP struct {
 	P float64
 }
 
-func PrbKMax(spn SPN, k int) XP {
-	return MaxXP(PrbK(spn, k))
+func PrbKMax(ctx context.Context, spn SPN, k int, r *rand.Rand) XP {
+	return MaxXP(PrbK(ctx, spn, k, r))
 }
 
 func MaxXP(xps []XP) XP {
@@ -28,36 +29,41 @@ func MaxXP(xps []XP) XP {
 	return max
 }
 
+// EvalXBatch evaluates the assignments xs in batched passes split across
+// GOMAXPROCS workers.
 func EvalXBatch(spn SPN, xs [][]int) []XP {
+	return zipXP(xs, spn.Flatten().EvalXBatchParallel(xs, 0))
+}
+
+func zipXP(xs [][]int, ps []float64) []XP {
 	xps := make([]XP, len(xs))
-	wg := sync.WaitGroup{}
 	for i, x := range xs {
-		wg.Add(1)
-		i, x := i, x
-		go func() {
-			xps[i] = XP{x, spn.EvalX(x)}
-			wg.Done()
-		}()
+		xps[i] = XP{x, ps[i]}
 	}
-	wg.Wait()
 	return xps
 }
 
-func PrbK(spn SPN, k int) []XP {
-	prt := partition(spn)
-	res := make([]XP, k)
+// PrbK draws k samples from spn, fewer if ctx is done first. The samples
+// depend only on r, not on the scheduling of the goroutines drawing them.
+func PrbK(ctx context.Context, spn SPN, k int, r *rand.Rand) []XP {
+	f := spn.Flatten()
+	prt := f.Partition()
+	xs := make([][]int, k)
+	seeds := sampleSeeds(r, k)
 	wg := sync.WaitGroup{}
 	for times := 0; times < k; times++ {
+		if ctx.Err() != nil {
+			k = times
+			break
+		}
 		wg.Add(1)
 		go func(i int) {
-			x := prb1(spn, prt)
-			p := spn.EvalX(x)
-			res[i] = XP{x, p}
+			xs[i] = f.Sample(prt, rand.New(rand.NewSource(seeds[i])))
 			wg.Done()
 		}(times)
 	}
 	wg.Wait()
-	return res
+	return zipXP(xs[:k], f.EvalXBatchParallel(xs[:k], 0))
 }
 
 func partition(spn SPN) []float64 {
@@ -71,7 +77,17 @@ func partition(spn SPN) []float64 {
 	return spn.Eval(ass)
 }
 
-func prb1(spn SPN, prt []float64) []int {
+// sampleSeeds draws from r the seed of each of k samples, so that sample i
+// is the same whether the samples are drawn serially or concurrently.
+func sampleSeeds(r *rand.Rand, k int) []int64 {
+	seeds := make([]int64, k)
+	for i := range seeds {
+		seeds[i] = r.Int63()
+	}
+	return seeds
+}
+
+func prb1(spn SPN, prt []float64, r *rand.Rand) []int {
 	x := make([]int, len(spn.Schema))
 	reach := make([]bool, len(spn.Nodes))
 	reach[len(spn.Nodes)-1] = true
@@ -81,11 +97,11 @@ func prb1(spn SPN, prt []float64) []int {
 			case *Trm:
 				x[n.Kth] = n.Value
 			case *Sum:
-				r := math.Log(rand.Float64()) + prt[i]
+				u := math.Log(r.Float64()) + prt[i]
 				crt := math.Inf(-1)
 				for _, e := range n.Edges {
-					crt = logSumExp(crt, e.Weight+prt[e.Node.ID()])
-					if r < crt {
+					crt = LogSumExp(crt, e.Weight+prt[e.Node.ID()])
+					if u < crt {
 						reach[e.Node.ID()] = true
 						break
 					}
@@ -177,9 +193,13 @@ func SumMax(spn SPN) []int {
 	return x
 }
 
-func NaiveBayes(spn SPN) []int {
+// NaiveBayes returns nil if ctx is done before it ends.
+func NaiveBayes(ctx context.Context, spn SPN) []int {
 	xs := make([]int, len(spn.Schema))
 	for i := range xs {
+		if ctx.Err() != nil {
+			return nil
+		}
 		sBest, pBest := -1, math.Inf(-1)
 		for j := 0; j < spn.Schema[i]; j++ {
 			ps := spn.Eval(marginalAss1(spn.Schema, i, j))
@@ -213,7 +233,9 @@ func marginalAss1(schema []int, kth int, val int) [][]float64 {
 	return ass
 }
 
-func BeamSearch(spn SPN, xps []XP, beamSize int) XP {
+func BeamSearch(ctx context.Context, spn SPN, xps []XP, beamSize int) XP {
+	f := spn.Flatten()
+	dvs := make([]*Derivatives, beamSize)
 	best := XP{P: math.Inf(-1)}
 	for i := 0; len(xps) > 0; i++ {
 		log.Printf("[ROUND %d][FRINGE %d] best: %f\n", i, len(xps), best.P)
@@ -222,18 +244,30 @@ func BeamSearch(spn SPN, xps []XP, beamSize int) XP {
 		xp1 := topK(xps, 1)
 		if best.P < xp1[0].P {
 			best = xp1[0]
+			report(ctx, best, math.Inf(1))
 		}
-		xps = nextGens(xps, spn)
+		select {
+		case <-ctx.Done():
+			return best
+		default:
+		}
+		xps = nextGens(xps, f, dvs)
 	}
 	return best
 }
 
-func nextGens(xps []XP, spn SPN) []XP {
+// nextGens returns the neighbours of the states xps that improve on them,
+// scoring xps[i] by a derivative pass into dvs[i] on its own goroutine. It
+// creates the buffers of f on first use; dvs must be at least as long as xps.
+func nextGens(xps []XP, f *Flat, dvs []*Derivatives) []XP {
 	res := []XP{}
 	resChan := make([]chan []XP, len(xps))
 	for i, xp := range xps {
+		if dvs[i] == nil {
+			dvs[i] = f.NewDerivatives()
+		}
 		ch := make(chan []XP)
-		go nextGenD(xp, spn, ch)
+		go nextGenD(xp, f, dvs[i], ch)
 		resChan[i] = ch
 	}
 	for _, ch := range resChan {
@@ -242,18 +276,19 @@ func nextGens(xps []XP, spn SPN) []XP {
 	return res
 }
 
-func nextGen(xp XP, spn SPN, ch chan []XP) {
+// nextGen is nextGenD evaluating each neighbour by a flip of inc, which it
+// moves to xp. A flip per neighbour costs more than the single derivative
+// pass, so the searches over many neighbours score with nextGenD.
+func nextGen(xp XP, inc *Incremental, ch chan []XP) {
 	res := []XP{}
-	for i, cnt := range spn.Schema {
+	inc.Set(xp.X)
+	for i, cnt := range inc.f.Schema {
 		for xi := 0; xi < cnt; xi++ {
 			if xp.X[i] != xi {
-				nx := make([]int, len(xp.X))
-				copy(nx, xp.X)
-				nx[i] = xi
-				np := spn.EvalX(nx)
-				if np > xp.P {
-					res = append(res, XP{nx, np})
+				if np := inc.Flip(i, xi); np > xp.P {
+					res = append(res, XP{inc.X(), np})
 				}
+				inc.Undo()
 			}
 		}
 	}
@@ -262,11 +297,12 @@ func nextGen(xp XP, spn SPN, ch chan []XP) {
 
 func nextGenP(xp XP, spn SPN, ch chan []XP) {
 	res := []XP{}
+	f := spn.Flatten()
 	chs := make([]chan []XP, len(spn.Schema))
 	for i, cnt := range spn.Schema {
 		chi := make(chan []XP)
 		chs[i] = chi
-		go genKth(cnt, xp, i, spn, chi)
+		go genKth(cnt, xp, i, f, chi)
 	}
 	for i := range chs {
 		res = append(res, <-chs[i]...)
@@ -274,34 +310,36 @@ func nextGenP(xp XP, spn SPN, ch chan []XP) {
 	ch <- res
 }
 
-func nextGenD(xp XP, spn SPN, ch chan []XP) {
+// nextGenD sends on ch the neighbours of xp, differing in one variable, that
+// improve on it, scoring each by the derivative of its terminal. It takes the
+// derivative buffers of f in dv.
+func nextGenD(xp XP, f *Flat, dv *Derivatives, ch chan []XP) {
 	res := []XP{}
-	ds := DerivativeX(spn, xp.X)
-	for i, n := range spn.Nodes {
-		if n, ok := n.(*Trm); ok {
-			if xp.X[n.Kth] != n.Value && ds[i] > xp.P {
+	dv.State = nil
+	f.Differentiate(context.Background(), X2Ass(xp.X, f.Schema), dv)
+	for i, kind := range f.Kind {
+		if kind == FlatTrm {
+			k, v := f.Kth[i], int(f.Value[i])
+			if xp.X[k] != v && dv.Node[i] > xp.P {
 				nx := make([]int, len(xp.X))
 				copy(nx, xp.X)
-				nx[n.Kth] = n.Value
-				res = append(res, XP{nx, ds[i]})
+				nx[k] = v
+				res = append(res, XP{nx, dv.Node[i]})
 			}
 		}
 	}
 	ch <- res
 }
 
-func genKth(cnt int, xp XP, i int, spn SPN, chi chan []XP) {
+func genKth(cnt int, xp XP, i int, f *Flat, chi chan []XP) {
 	r := []XP{}
+	inc := NewIncremental(f, xp.X)
 	for xi := 0; xi < cnt; xi++ {
 		if xp.X[i] != xi {
-			nx := make([]int, len(xp.X))
-			copy(nx, xp.X)
-			nx[i] = xi
-			np := spn.EvalX(nx)
-			if np > xp.P {
-				//res = append(res, XP{nx, np})
-				r = append(r, XP{nx, np})
+			if np := inc.Flip(i, xi); np > xp.P {
+				r = append(r, XP{inc.X(), np})
 			}
+			inc.Undo()
 		}
 	}
 	chi <- r
@@ -339,6 +377,9 @@ func topK(xps []XP, k int) []XP {
 	return xps[:k]
 }
 
+// Max returns the max-product value of spn, the value of its best induced
+// tree. It bounds the MAP value from below, not from above: every tree value
+// is a term of the network polynomial at some assignment.
 func Max(spn SPN) float64 {
 	val := make([]float64, len(spn.Nodes))
 	for i, n := range spn.Nodes {
@@ -366,143 +407,33 @@ func DerivativeX(spn SPN, xs []int) []float64 {
 	return DerivativeS(spn, X2Ass(xs, spn.Schema))
 }
 
+// Derivative is DerivativeS.
 func Derivative(spn SPN, as [][]float64) []float64 {
-	pr := spn.Eval(as)
-	dr := make([]float64, len(spn.Nodes))
-	for i := range dr {
-		dr[i] = math.Inf(-1)
-	}
-	dr[len(dr)-1] = 0.0
-	for i := len(spn.Nodes) - 1; i >= 0; i-- {
-		switch n := spn.Nodes[i].(type) {
-		case *Sum:
-			for _, e := range n.Edges {
-				dr[e.Node.ID()] = logSumExp(dr[e.Node.ID()], dr[i]+e.Weight)
-			}
-		case *Prd:
-			for j, e := range n.Edges {
-				other := 0.0
-				for k, e := range n.Edges {
-					if j != k {
-						other += pr[e.Node.ID()]
-					}
-				}
-				dr[e.Node.ID()] = logSumExp(dr[e.Node.ID()], dr[i]+other)
-			}
-		}
-	}
-	return dr
+	return DerivativeS(spn, as)
 }
 
+// DerivativeS returns the log-derivatives of the root of spn at as with
+// respect to every node, by Differentiate. It compiles spn on every call;
+// loops over one network reuse a Flat and its Derivatives instead.
 func DerivativeS(spn SPN, as [][]float64) []float64 {
-	pr := spn.Eval(as)
-	dr := make([]float64, len(spn.Nodes))
-	for i := range dr {
-		dr[i] = math.Inf(-1)
-	}
-	dr[len(dr)-1] = 0.0
-	for i := len(spn.Nodes) - 1; i >= 0; i-- {
-		switch n := spn.Nodes[i].(type) {
-		case *Sum:
-			for _, e := range n.Edges {
-				dr[e.Node.ID()] = logSumExp(dr[e.Node.ID()], dr[i]+e.Weight)
-			}
-		case *Prd:
-			zeroCnt := 0
-			for _, e := range n.Edges {
-				if math.IsInf(pr[e.Node.ID()], -1) {
-					zeroCnt++
-					if zeroCnt == 2 {
-						break
-					}
-				}
-			}
-			for _, e := range n.Edges {
-				other := 0.0
-				if zeroCnt == 0 {
-					other = pr[i] - pr[e.Node.ID()]
-				} else if zeroCnt == 1 {
-					if math.IsInf(pr[e.Node.ID()], -1) {
-						for _, f := range n.Edges {
-							if !math.IsInf(pr[f.Node.ID()], -1) {
-								other += pr[f.Node.ID()]
-							}
-						}
-					} else {
-						other = math.Inf(-1)
-					}
-				} else {
-					other = math.Inf(-1)
-				}
-				dr[e.Node.ID()] = logSumExp(dr[e.Node.ID()], dr[i]+other)
-			}
-		}
-	}
-	return dr
+	return derivativeS(context.Background(), spn, as)
 }
 
-func DerivativeSS(spn SPN, as [][]float64) []float64 {
-	pr := make([]float64, len(spn.Nodes))
-	zc := make([]int, len(spn.Nodes))
-	for i, n := range spn.Nodes {
-		switch n := n.(type) {
-		case *Trm:
-			pr[i] = math.Log(as[n.Kth][n.Value])
-		case *Sum:
-			pr[i] = logSumExpF(len(n.Edges), func(k int) float64 {
-				if zc[n.Edges[k].Node.ID()] > 0 {
-					return math.Inf(-1)
-				}
-				return n.Edges[k].Weight + pr[n.Edges[k].Node.ID()]
-			})
-		case *Prd:
-			prd := 0.0
-			z := 0
-			for _, e := range n.Edges {
-				if math.IsInf(pr[e.Node.ID()], -1) {
-					z++
-					if z == 2 {
-						break
-					}
-				} else {
-					prd += pr[e.Node.ID()]
-				}
-			}
-			zc[i] = z
-			pr[i] = prd
-		}
+// derivativeS is DerivativeS that returns nil if ctx is done before the
+// passes end.
+func derivativeS(ctx context.Context, spn SPN, as [][]float64) []float64 {
+	f := spn.Flatten()
+	dv := f.NewDerivatives()
+	dv.State = nil
+	if !f.Differentiate(ctx, as, dv) {
+		return nil
 	}
+	return dv.Node
+}
 
-	dr := make([]float64, len(spn.Nodes))
-	for i := range dr {
-		dr[i] = math.Inf(-1)
-	}
-	dr[len(dr)-1] = 0.0
-	for i := len(spn.Nodes) - 1; i >= 0; i-- {
-		switch n := spn.Nodes[i].(type) {
-		case *Sum:
-			for _, e := range n.Edges {
-				dr[e.Node.ID()] = logSumExp(dr[e.Node.ID()], dr[i]+e.Weight)
-			}
-		case *Prd:
-			for _, e := range n.Edges {
-				other := 0.0
-				if zc[i] == 0 {
-					other = pr[i] - pr[e.Node.ID()]
-				} else if zc[i] == 1 {
-					if math.IsInf(pr[e.Node.ID()], -1) {
-						other = pr[i]
-					} else {
-						other = math.Inf(-1)
-					}
-				} else {
-					other = math.Inf(-1)
-				}
-				dr[e.Node.ID()] = logSumExp(dr[e.Node.ID()], dr[i]+other)
-			}
-		}
-	}
-	return dr
+// DerivativeSS is DerivativeS.
+func DerivativeSS(spn SPN, as [][]float64) []float64 {
+	return DerivativeS(spn, as)
 }
 
 type Link struct {
@@ -512,9 +443,16 @@ type Link struct {
 	Trm   *Trm
 }
 
-func TopKMaxMax(spn SPN, k int) [][]int {
+// TopKMaxMax returns the assignments of the k best max-product trees, or nil
+// if ctx is done before it ends.
+func TopKMaxMax(ctx context.Context, spn SPN, k int) [][]int {
 	ls := make([][]*Link, len(spn.Nodes))
 	for i, n := range spn.Nodes {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
 		switch n := n.(type) {
 		case *Trm:
 			ls[i] = []*Link{{P: 0, Trm: n}}
@@ -626,9 +564,17 @@ func mergeSumLink(left, right []*Link, leftWeight, rightWeight float64, k int) [
 	return rs
 }
 
-func MC(spn SPN) XP {
+// MC is the Argmax-Product method. It returns an XP with NaN P if ctx is
+// done before it ends.
+func MC(ctx context.Context, spn SPN) XP {
 	mc := make([]XP, len(spn.Nodes))
+	expired := XP{X: nil, P: math.NaN()}
 	for i, n := range spn.Nodes {
+		select {
+		case <-ctx.Done():
+			return expired
+		default:
+		}
 		switch n := n.(type) {
 		case *Trm:
 			x := make([]int, len(spn.Schema))
@@ -640,6 +586,11 @@ func MC(spn SPN) XP {
 		case *Sum:
 			xpBest := XP{nil, math.Inf(-1)}
 			for _, e := range n.Edges {
+				select {
+				case <-ctx.Done():
+					return expired
+				default:
+				}
 				p := evalAt(spn, mc[e.Node.ID()].X, i)
 				if xpBest.P < p {
 					xpBest = XP{mc[e.Node.ID()].X, p}
@@ -692,3 +643,68 @@ func evalAt(spn SPN, x []int, at int) float64 {
 	}
 	return val[at]
 }
+
+func BeamSearchSerial(ctx context.Context, spn SPN, xps []XP, beamSize int) XP {
+	return beamSearchSerial(ctx, spn, xps, beamSize, &Stats{})
+}
+
+func beamSearchSerial(ctx context.Context, spn SPN, xps []XP, beamSize int, st *Stats) XP {
+	f := spn.Flatten()
+	dv := f.NewDerivatives()
+	best := XP{P: math.Inf(-1)}
+	for i := 0; len(xps) > 0; i++ {
+		xps = uniqueX(xps)
+		xps = topK(xps, beamSize)
+		xp1 := topK(xps, 1)
+		if best.P < xp1[0].P {
+			best = xp1[0]
+			report(ctx, best, math.Inf(1))
+		}
+		select {
+		case <-ctx.Done():
+			return best
+		default:
+		}
+		st.Expanded += len(xps)
+		st.Derivatives += len(xps)
+		xps = nextGensSerial(ctx, xps, f, dv)
+	}
+	return best
+}
+
+// nextGensSerial is nextGens on the calling goroutine. It returns the
+// neighbours found so far once ctx is done.
+func nextGensSerial(ctx context.Context, xps []XP, f *Flat, dv *Derivatives) []XP {
+	res := []XP{}
+	ch := make(chan []XP, 1)
+	for _, xp := range xps {
+		if ctx.Err() != nil {
+			break
+		}
+		nextGenD(xp, f, dv, ch)
+		res = append(res, <-ch...)
+	}
+	return res
+}
+
+// PrbKSerial is PrbK on the calling goroutine. It draws the same samples as
+// PrbK from the same r.
+func PrbKSerial(ctx context.Context, spn SPN, k int, r *rand.Rand) []XP {
+	f := spn.Flatten()
+	prt := f.Partition()
+	xs := make([][]int, k)
+	seeds := sampleSeeds(r, k)
+	for times := 0; times < k; times++ {
+		if ctx.Err() != nil {
+			k = times
+			break
+		}
+		xs[times] = f.Sample(prt, rand.New(rand.NewSource(seeds[times])))
+	}
+	return zipXP(xs[:k], f.EvalXBatch(xs[:k]))
+}
+
+// EvalXBatchSerial is EvalXBatch on the calling goroutine.
+func EvalXBatchSerial(spn SPN, xs [][]int) []XP {
+	return zipXP(xs, spn.Flatten().EvalXBatch(xs))
+}
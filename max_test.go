@@ -1,20 +1,23 @@
-package main
+package maxspn
 
 import (
+	"context"
 	"math"
 	"math/rand"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestPrbK(t *testing.T) {
 	spn := AC2SPN(LoadAC("data/idspac/nltcs.ac"))
-	t.Log(PrbKMax(spn, 1))
-	t.Log(PrbKMax(spn, 1))
-	t.Log(PrbKMax(spn, 1))
-	t.Log(PrbKMax(spn, 1))
-	t.Log(PrbKMax(spn, 1))
-	t.Log(PrbKMax(spn, 10))
-	t.Log(PrbKMax(spn, 100))
+	t.Log(PrbKMax(context.Background(), spn, 1, rand.New(rand.NewSource(0))))
+	t.Log(PrbKMax(context.Background(), spn, 1, rand.New(rand.NewSource(0))))
+	t.Log(PrbKMax(context.Background(), spn, 1, rand.New(rand.NewSource(0))))
+	t.Log(PrbKMax(context.Background(), spn, 1, rand.New(rand.NewSource(0))))
+	t.Log(PrbKMax(context.Background(), spn, 1, rand.New(rand.NewSource(0))))
+	t.Log(PrbKMax(context.Background(), spn, 10, rand.New(rand.NewSource(0))))
+	t.Log(PrbKMax(context.Background(), spn, 100, rand.New(rand.NewSource(0))))
 }
 
 func TestMaxMax(t *testing.T) {
@@ -31,13 +34,13 @@ func TestSumMax(t *testing.T) {
 
 func TestNaiveBayes(t *testing.T) {
 	spn := AC2SPN(LoadAC("data/idspac/nltcs.ac"))
-	x := NaiveBayes(spn)
+	x := NaiveBayes(context.Background(), spn)
 	t.Log(x, spn.EvalX(x))
 }
 
 func TestBeamSearch(t *testing.T) {
 	spn := AC2SPN(LoadAC("data/idspac/nltcs.ac"))
-	t.Log(BeamSearch(spn, PrbK(spn, 100), 16))
+	t.Log(BeamSearch(context.Background(), spn, PrbK(context.Background(), spn, 100, rand.New(rand.NewSource(0))), 16))
 }
 
 func TestMax(t *testing.T) {
@@ -111,10 +114,71 @@ func TestDerivativeSS(t *testing.T) {
 func TestTopKMaxMax(t *testing.T) {
 	spn := LoadSPN(TY_SPN + "4")
 	//spn := LoadSPN(LR_SPN + "dna")
-	xs := TopKMaxMax(spn, 100)
+	xs := TopKMaxMax(context.Background(), spn, 100)
 	xm := MaxMax(spn)
 	t.Log(" ", spn.EvalX(xm), xm)
 	for i, x := range xs {
 		t.Log(i, spn.EvalX(x), x)
 	}
 }
+
+func TestPrbK_Seeded(t *testing.T) {
+	spn := randomSPN(rand.New(rand.NewSource(1)), []int{2, 3, 2, 4, 2, 2})
+	ctx := context.Background()
+	a := PrbK(ctx, spn, 50, rand.New(rand.NewSource(7)))
+	b := PrbK(ctx, spn, 50, rand.New(rand.NewSource(7)))
+	c := PrbKSerial(ctx, spn, 50, rand.New(rand.NewSource(7)))
+	if !reflect.DeepEqual(a, b) || !reflect.DeepEqual(a, c) {
+		t.Errorf("samples of one seed differ:\n%v\n%v\n%v", a, b, c)
+	}
+	if d := PrbK(ctx, spn, 50, rand.New(rand.NewSource(8))); reflect.DeepEqual(a, d) {
+		t.Errorf("seeds 7 and 8 draw the same samples %v", a)
+	}
+}
+
+// cancelAfter is a context canceled by the n-th call of its Done or Err, so
+// that a search sees it canceled at a chosen check.
+type cancelAfter struct {
+	context.Context
+	cancel context.CancelFunc
+	n      int
+}
+
+func (c *cancelAfter) tick() {
+	if c.n--; c.n == 0 {
+		c.cancel()
+	}
+}
+
+func (c *cancelAfter) Done() <-chan struct{} {
+	c.tick()
+	return c.Context.Done()
+}
+
+func (c *cancelAfter) Err() error {
+	c.tick()
+	return c.Context.Err()
+}
+
+func TestBeamSearchSerial_Cancel(t *testing.T) {
+	r := rand.New(rand.NewSource(4))
+	schema := []int{2, 3, 2, 4, 2, 2, 3, 2, 2, 2}
+	for n := 1; n <= 6; n++ {
+		spn := randomSPN(r, schema)
+		ctx, cancel := context.WithCancel(context.Background())
+		xps := PrbKSerial(context.Background(), spn, 8, r)
+		done := make(chan XP, 1)
+		go func() {
+			done <- BeamSearchSerial(&cancelAfter{ctx, cancel, n}, spn, xps, 8)
+		}()
+		select {
+		case xp := <-done:
+			if p := spn.EvalX(xp.X); math.Abs(p-xp.P) > 1e-9 {
+				t.Errorf("returned %v, which scores %v", xp, p)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("BeamSearchSerial canceled at check %d did not return", n)
+		}
+		cancel()
+	}
+}
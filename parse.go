@@ -0,0 +1,118 @@
+package maxspn
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ParseError reports a malformed line of a model file.
+type ParseError struct {
+	Line int // 1-based line number
+	Msg  string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// modelScanner reads the line-oriented model formats shared by .spn and .ac
+// files: a schema header, one node per line and a closing EOF line.
+type modelScanner struct {
+	sc   *bufio.Scanner
+	line int
+}
+
+func newModelScanner(r io.Reader) *modelScanner {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), math.MaxInt32)
+	return &modelScanner{sc: sc}
+}
+
+func (ms *modelScanner) errorf(format string, args ...interface{}) error {
+	return &ParseError{ms.line, fmt.Sprintf(format, args...)}
+}
+
+// next returns the fields of the next line, or done if the line is EOF.
+func (ms *modelScanner) next() (fields []string, done bool, err error) {
+	if !ms.sc.Scan() {
+		if err := ms.sc.Err(); err != nil {
+			return nil, false, err
+		}
+		ms.line++
+		return nil, false, ms.errorf("missing EOF")
+	}
+	ms.line++
+	ln := strings.TrimSpace(ms.sc.Text())
+	if ln == "EOF" {
+		return nil, true, nil
+	}
+	return strings.Fields(ln), false, nil
+}
+
+func (ms *modelScanner) schema() ([]int, error) {
+	if !ms.sc.Scan() {
+		if err := ms.sc.Err(); err != nil {
+			return nil, err
+		}
+		ms.line++
+		return nil, ms.errorf("missing schema header")
+	}
+	ms.line++
+	ln := strings.TrimSpace(ms.sc.Text())
+	if len(ln) < 2 || ln[0] != '(' || ln[len(ln)-1] != ')' {
+		return nil, ms.errorf("bad schema header %q", ln)
+	}
+	fs := strings.Fields(ln[1 : len(ln)-1])
+	if len(fs) == 0 {
+		return nil, ms.errorf("empty schema")
+	}
+	schema := make([]int, len(fs))
+	for i, f := range fs {
+		c, err := strconv.ParseInt(f, 0, 0)
+		if err != nil || c < 1 {
+			return nil, ms.errorf("bad cardinality %q of variable %d", f, i)
+		}
+		schema[i] = int(c)
+	}
+	return schema, nil
+}
+
+// variable parses the arguments of a "v kth value" line.
+func (ms *modelScanner) variable(args []string, schema []int) (kth, value int, err error) {
+	if len(args) != 2 {
+		return 0, 0, ms.errorf("variable node needs 2 arguments, got %d", len(args))
+	}
+	k, err := strconv.ParseInt(args[0], 0, 0)
+	if err != nil || k < 0 || int(k) >= len(schema) {
+		return 0, 0, ms.errorf("variable %q out of schema range [0, %d)", args[0], len(schema))
+	}
+	v, err := strconv.ParseInt(args[1], 0, 0)
+	if err != nil || v < 0 || int(v) >= schema[k] {
+		return 0, 0, ms.errorf("value %q of variable %d out of schema range [0, %d)", args[1], k, schema[k])
+	}
+	return int(k), int(v), nil
+}
+
+// child parses a child index of node id, which must refer to an earlier node.
+func (ms *modelScanner) child(arg string, id int) (int, error) {
+	c, err := strconv.ParseInt(arg, 0, 0)
+	if err != nil {
+		return 0, ms.errorf("bad child index %q", arg)
+	}
+	if c < 0 || int(c) >= id {
+		return 0, ms.errorf("child %d of node %d is not defined before it", c, id)
+	}
+	return int(c), nil
+}
+
+func (ms *modelScanner) float(arg string) (float64, error) {
+	f, err := strconv.ParseFloat(arg, 64)
+	if err != nil {
+		return 0, ms.errorf("bad number %q", arg)
+	}
+	return f, nil
+}
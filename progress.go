@@ -0,0 +1,64 @@
+package maxspn
+
+import (
+	"context"
+	"time"
+)
+
+// Improvement is a new incumbent found by a running solver.
+type Improvement struct {
+	XP                    // improved assignment and its log-probability
+	Elapsed time.Duration // time since the solver started
+	Upper   float64       // global upper bound of the MAP value, +Inf if unknown
+}
+
+type progressKey struct{}
+
+type progress struct {
+	fn    func(Improvement)
+	start time.Time
+}
+
+// WithProgress returns a copy of ctx under which the anytime solvers (the
+// exact searches and beam search) call fn with every improved assignment.
+// fn runs on the solver's goroutine and must not retain the assignment
+// beyond the call unless it copies it; to stop once the gap between P and
+// Upper is small enough, cancel ctx from fn.
+func WithProgress(ctx context.Context, fn func(Improvement)) context.Context {
+	return context.WithValue(ctx, progressKey{}, &progress{fn, time.Now()})
+}
+
+func progressOf(ctx context.Context) *progress {
+	p, _ := ctx.Value(progressKey{}).(*progress)
+	return p
+}
+
+// report passes xp to the progress function of ctx, if any.
+func report(ctx context.Context, xp XP, upper float64) {
+	if p := progressOf(ctx); p != nil {
+		p.report(xp, upper)
+	}
+}
+
+func (p *progress) report(xp XP, upper float64) {
+	if p == nil {
+		return
+	}
+	p.fn(Improvement{XP: xp, Elapsed: time.Since(p.start), Upper: upper})
+}
+
+// remap returns a context whose progress function maps assignments with f
+// and measures time from now, or ctx itself if it has no progress function.
+func remap(ctx context.Context, f func([]int) []int) context.Context {
+	p := progressOf(ctx)
+	if p == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, progressKey{}, &progress{
+		fn: func(im Improvement) {
+			im.X = f(im.X)
+			p.fn(im)
+		},
+		start: time.Now(),
+	})
+}
@@ -0,0 +1,134 @@
+package maxspn
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Query gives every variable of an SPN its role in a MAP query: QueryVar for
+// a variable to maximize over, HiddenVar for a variable to sum out, and a
+// state value for an evidence variable. A partial assignment, with -1 for
+// the free variables, is a Query without hidden variables.
+type Query []int
+
+const (
+	QueryVar  = -1
+	HiddenVar = -2
+)
+
+// ParseQuery parses a line of a QEH file: one token per variable, '?' for a
+// query variable, '*' for a hidden one and a decimal state value for
+// evidence, separated by commas or white space. A line without separators
+// that holds a '?' or '*' is read one byte per variable, so its evidence
+// values must be single digits; values of more digits need the separators.
+// Any other line without separators is a single token, as in "12".
+func ParseQuery(s string) (Query, error) {
+	s = strings.TrimSpace(s)
+	tokens := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+	if len(tokens) == 1 && len(s) > 1 && strings.ContainsAny(s, "?*") {
+		tokens = strings.Split(s, "")
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty query")
+	}
+	q := make(Query, len(tokens))
+	for i, t := range tokens {
+		switch t {
+		case "?":
+			q[i] = QueryVar
+		case "*":
+			q[i] = HiddenVar
+		default:
+			v, err := strconv.Atoi(t)
+			if err != nil || v < 0 {
+				return nil, fmt.Errorf("bad token %q of variable %d", t, i)
+			}
+			q[i] = v
+		}
+	}
+	return q, nil
+}
+
+// String formats q as a line of a QEH file, with comma separators.
+func (q Query) String() string {
+	data := make([]byte, 0, 2*len(q))
+	for i, v := range q {
+		if i > 0 {
+			data = append(data, ',')
+		}
+		switch v {
+		case QueryVar:
+			data = append(data, '?')
+		case HiddenVar:
+			data = append(data, '*')
+		default:
+			data = strconv.AppendInt(data, int64(v), 10)
+		}
+	}
+	return string(data)
+}
+
+// Validate checks q against the schema of an SPN: one role per variable,
+// evidence values in range and at least one query variable.
+func (q Query) Validate(schema []int) error {
+	if len(q) != len(schema) {
+		return fmt.Errorf("query has %d variables, SPN has %d", len(q), len(schema))
+	}
+	for i, v := range q {
+		if v < HiddenVar || v >= schema[i] {
+			return fmt.Errorf("evidence %d of variable %d out of schema range [0, %d)", v, i, schema[i])
+		}
+	}
+	if len(q.QueryVars()) == 0 {
+		return fmt.Errorf("query has no query variable")
+	}
+	return nil
+}
+
+// QueryVars returns the query variables of q in increasing order.
+func (q Query) QueryVars() []int {
+	return q.vars(func(v int) bool { return v == QueryVar })
+}
+
+// HiddenVars returns the hidden variables of q in increasing order.
+func (q Query) HiddenVars() []int {
+	return q.vars(func(v int) bool { return v == HiddenVar })
+}
+
+// EvidenceVars returns the evidence variables of q in increasing order.
+func (q Query) EvidenceVars() []int {
+	return q.vars(func(v int) bool { return v >= 0 })
+}
+
+func (q Query) vars(f func(v int) bool) []int {
+	vs := []int{}
+	for i, v := range q {
+		if f(v) {
+			vs = append(vs, i)
+		}
+	}
+	return vs
+}
+
+// Expand maps an assignment of the query variables of q, such as a MAP
+// assignment of QuerySPN(q), to one of all the variables: evidence values
+// are copied from q and hidden variables set to -1.
+func (q Query) Expand(qx []int) []int {
+	x := make([]int, len(q))
+	k := 0
+	for i, v := range q {
+		switch v {
+		case QueryVar:
+			x[i] = qx[k]
+			k++
+		case HiddenVar:
+			x[i] = -1
+		default:
+			x[i] = v
+		}
+	}
+	return x
+}
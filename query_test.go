@@ -0,0 +1,82 @@
+package maxspn
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func mustParseQuery(s string) Query {
+	q, err := ParseQuery(s)
+	if err != nil {
+		panic(err)
+	}
+	return q
+}
+
+func TestParseQuery(t *testing.T) {
+	for _, test := range []struct {
+		s    string
+		want Query
+	}{
+		{"?*01", Query{QueryVar, HiddenVar, 0, 1}},
+		{"?,*,12,1\n", Query{QueryVar, HiddenVar, 12, 1}},
+		{"? * 12\t3", Query{QueryVar, HiddenVar, 12, 3}},
+		{"7", Query{7}},
+		{"12", Query{12}},
+		{"?12", Query{QueryVar, 1, 2}},
+	} {
+		q, err := ParseQuery(test.s)
+		if err != nil || !reflect.DeepEqual(q, test.want) {
+			t.Errorf("ParseQuery(%q) = %v, %v, want %v", test.s, q, err, test.want)
+		}
+		if back, err := ParseQuery(q.String()); err != nil || !reflect.DeepEqual(back, q) {
+			t.Errorf("ParseQuery(%q) = %v, %v, want %v", q.String(), back, err, q)
+		}
+	}
+	for _, s := range []string{"", " , ", "?x", "?,-1", "?,1.5", "1x"} {
+		if q, err := ParseQuery(s); err == nil {
+			t.Errorf("ParseQuery(%q) = %v, want an error", s, q)
+		}
+	}
+}
+
+func TestQuery_Validate(t *testing.T) {
+	schema := []int{2, 3, 12}
+	q := Query{HiddenVar, QueryVar, 11}
+	if err := q.Validate(schema); err != nil {
+		t.Errorf("Validate(%v): %v", q, err)
+	}
+	if got := [][]int{q.QueryVars(), q.HiddenVars(), q.EvidenceVars()}; !reflect.DeepEqual(got, [][]int{{1}, {0}, {2}}) {
+		t.Errorf("variables of %v: %v", q, got)
+	}
+	if x := q.Expand([]int{2}); !reflect.DeepEqual(x, []int{-1, 2, 11}) {
+		t.Errorf("Expand: %v", x)
+	}
+	for _, q := range []Query{{QueryVar, QueryVar}, {HiddenVar, 0, 1}, {QueryVar, 3, 0}, {QueryVar, 0, 12}, {-3, QueryVar, 0}} {
+		if err := q.Validate(schema); err == nil {
+			t.Errorf("Validate(%v) succeeded", q)
+		}
+	}
+}
+
+func TestMethod_SolveLargeEvidence(t *testing.T) {
+	r := rand.New(rand.NewSource(4))
+	schema := []int{2, 12, 3, 11, 2}
+	for times := 0; times < 5; times++ {
+		spn := randomSPN(r, schema)
+		q := mustParseQuery("?,10,*,?,?")
+		want := bruteForceMAP(spn, q)
+		for name, m := range map[string]Method{"MP": MP(), "STAGE": STAGE(), "EXACT": EXACT()} {
+			res, err := m.Solve(context.Background(), spn, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(res.P-want.P) > 1e-9 || res.X[1] != 10 || res.X[2] != -1 {
+				t.Errorf("%s: got %v %f, want %v %f", name, res.X, res.P, want.X, want.P)
+			}
+		}
+	}
+}
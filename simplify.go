@@ -0,0 +1,174 @@
+package maxspn
+
+import "math"
+
+// Size counts the nodes and edges of a network.
+type Size struct {
+	Nodes int
+	Edges int
+}
+
+// Size returns the size of spn, not counting nil slots.
+func (spn SPN) Size() Size {
+	s := Size{}
+	for _, n := range spn.Nodes {
+		switch n := n.(type) {
+		case *Trm:
+			s.Nodes++
+		case *Sum:
+			s.Nodes++
+			s.Edges += len(n.Edges)
+		case *Prd:
+			s.Nodes++
+			s.Edges += len(n.Edges)
+		}
+	}
+	return s
+}
+
+// Simplify returns a network with the same value as spn at every assignment
+// and the same variables, reduced structurally:
+//
+//   - sum edges of weight zero and the nodes that are zero everywhere, sums
+//     without edges and the products over them, are dropped;
+//   - products with a single child, and sums with a single edge of weight 1,
+//     are replaced by the child;
+//   - sums and products are merged into their parent of the same kind if the
+//     parent is their only one, and sums with a single edge into every sum
+//     parent, its weight multiplied into the parent edge;
+//   - the nodes unreachable from the root, and nil slots, are dropped.
+//
+// The nodes keep their relative order and get compact IDs. It also returns
+// the sizes of spn and of the result. A network that is zero everywhere
+// becomes a single sum without edges.
+func (spn SPN) Simplify() (SPN, Size, Size) {
+	nn := len(spn.Nodes)
+	to := make([]int, nn) // node that stands for node i
+	zero := make([]bool, nn)
+	cs := make([][]int, nn)
+	ws := make([][]float64, nn)
+	for i, n := range spn.Nodes {
+		to[i] = i
+		switch n := n.(type) {
+		case *Sum:
+			for _, e := range n.Edges {
+				if c := to[e.Node.ID()]; !zero[c] && !math.IsInf(e.Weight, -1) {
+					cs[i] = append(cs[i], c)
+					ws[i] = append(ws[i], e.Weight)
+				}
+			}
+			if len(cs[i]) == 0 {
+				zero[i] = true
+			} else if len(cs[i]) == 1 && ws[i][0] == 0 {
+				to[i] = cs[i][0]
+			}
+		case *Prd:
+			for _, e := range n.Edges {
+				c := to[e.Node.ID()]
+				if zero[c] {
+					zero[i], cs[i] = true, nil
+					break
+				}
+				cs[i] = append(cs[i], c)
+			}
+			if len(cs[i]) == 1 {
+				to[i] = cs[i][0]
+			}
+		}
+	}
+	root := to[nn-1]
+	if zero[root] {
+		return SPN{[]Node{&Sum{}}, spn.Schema}, spn.Size(), Size{Nodes: 1}
+	}
+
+	parents := make([]int, nn)
+	reach := make([]bool, nn)
+	reach[root] = true
+	for i := root; i >= 0; i-- {
+		if reach[i] {
+			for _, c := range cs[i] {
+				reach[c] = true
+				parents[c]++
+			}
+		}
+	}
+	sameKind := func(i, c int) bool {
+		switch spn.Nodes[i].(type) {
+		case *Sum:
+			_, ok := spn.Nodes[c].(*Sum)
+			return ok
+		case *Prd:
+			_, ok := spn.Nodes[c].(*Prd)
+			return ok
+		}
+		return false
+	}
+	for i := 0; i <= root; i++ {
+		if !reach[i] || len(cs[i]) == 0 {
+			continue
+		}
+		_, sum := spn.Nodes[i].(*Sum)
+		var ics []int
+		var iws []float64
+		for k, c := range cs[i] {
+			if !sameKind(i, c) || parents[c] > 1 && !(sum && len(cs[c]) == 1) {
+				ics = append(ics, c)
+				if sum {
+					iws = append(iws, ws[i][k])
+				}
+				continue
+			}
+			parents[c]--
+			for l, d := range cs[c] {
+				ics = append(ics, d)
+				if sum {
+					iws = append(iws, ws[i][k]+ws[c][l])
+				}
+				parents[d]++
+				if parents[c] == 0 {
+					parents[d]--
+				}
+			}
+		}
+		cs[i], ws[i] = ics, iws
+	}
+
+	for i := range reach {
+		reach[i] = false
+	}
+	reach[root] = true
+	for i := root; i >= 0; i-- {
+		if reach[i] {
+			for _, c := range cs[i] {
+				reach[c] = true
+			}
+		}
+	}
+	ns := make([]Node, nn)
+	nodes := []Node{}
+	for i := 0; i <= root; i++ {
+		if !reach[i] {
+			continue
+		}
+		switch n := spn.Nodes[i].(type) {
+		case *Trm:
+			ns[i] = &Trm{Kth: n.Kth, Value: n.Value}
+		case *Sum:
+			es := make([]SumEdge, len(cs[i]))
+			for k, c := range cs[i] {
+				es[k] = SumEdge{ws[i][k], ns[c]}
+			}
+			ns[i] = &Sum{Edges: es}
+		case *Prd:
+			es := make([]PrdEdge, len(cs[i]))
+			for k, c := range cs[i] {
+				es[k] = PrdEdge{ns[c]}
+			}
+			ns[i] = &Prd{Edges: es}
+		}
+		ns[i].SetID(len(nodes))
+		nodes = append(nodes, ns[i])
+	}
+	simple := SPN{nodes, spn.Schema}
+	return simple, spn.Size(), simple.Size()
+}
@@ -0,0 +1,125 @@
+package maxspn
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// checkSimplified checks that simple is a compact and simplified form of spn
+// with the same values.
+func checkSimplified(t *testing.T, r *rand.Rand, spn, simple SPN) {
+	parents := make([]int, len(simple.Nodes))
+	for i, n := range simple.Nodes {
+		if n.ID() != i {
+			t.Fatalf("node %d has ID %d", i, n.ID())
+		}
+		switch n := n.(type) {
+		case *Sum:
+			for _, e := range n.Edges {
+				if math.IsInf(e.Weight, -1) || e.Node.ID() >= i {
+					t.Fatalf("sum %d has edge %v to %d", i, e.Weight, e.Node.ID())
+				}
+				parents[e.Node.ID()]++
+			}
+			if len(n.Edges) == 1 && n.Edges[0].Weight == 0 {
+				t.Errorf("sum %d has a single edge of weight 1", i)
+			}
+		case *Prd:
+			if len(n.Edges) == 1 {
+				t.Errorf("product %d has a single child", i)
+			}
+			for _, e := range n.Edges {
+				if e.Node.ID() >= i {
+					t.Fatalf("product %d has child %d", i, e.Node.ID())
+				}
+				parents[e.Node.ID()]++
+			}
+		}
+	}
+	for i, n := range simple.Nodes {
+		if parents[i] == 0 && i != len(simple.Nodes)-1 {
+			t.Errorf("node %d is unreachable", i)
+		}
+		switch n := n.(type) {
+		case *Sum:
+			for _, e := range n.Edges {
+				if c, ok := e.Node.(*Sum); ok && (parents[c.ID()] == 1 || len(c.Edges) == 1) {
+					t.Errorf("sum %d has a sum child %d to merge", i, c.ID())
+				}
+			}
+		case *Prd:
+			for _, e := range n.Edges {
+				if _, ok := e.Node.(*Prd); ok && parents[e.Node.ID()] == 1 {
+					t.Errorf("product %d has a product child %d to merge", i, e.Node.ID())
+				}
+			}
+		}
+	}
+	for k := 0; k < 20; k++ {
+		x := make([]int, len(spn.Schema))
+		for i := range x {
+			x[i] = r.Intn(spn.Schema[i]+1) - 1
+		}
+		got, want := simple.EvalX(x), spn.EvalX(x)
+		if got != want && math.Abs(got-want) > 1e-12*math.Max(1, math.Abs(want)) {
+			t.Errorf("EvalX(%v) = %v, want %v", x, got, want)
+		}
+	}
+}
+
+func TestSPN_Simplify(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	schema := []int{2, 3, 2, 4, 2, 2, 3, 2}
+	for times := 0; times < 20; times++ {
+		spn := randomSPN(r, schema)
+		q := make(Query, len(schema))
+		for i := range q {
+			q[i] = []int{QueryVar, QueryVar, QueryVar, HiddenVar, 0, 1}[r.Intn(6)]
+		}
+		q[r.Intn(len(q))] = QueryVar
+		ac, err := randomBN(r, schema).Compile(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range []SPN{spn, spn.QuerySPN(q), spn.FastStageSPN(q), AC2SPN(ac)} {
+			simple, before, after := s.Simplify()
+			if before != s.Size() || after != simple.Size() {
+				t.Errorf("sizes %v %v, want %v %v", before, after, s.Size(), simple.Size())
+			}
+			if after.Nodes > before.Nodes || after.Edges > before.Edges {
+				t.Errorf("Simplify grew %v to %v", before, after)
+			}
+			checkSimplified(t, r, s, simple)
+		}
+	}
+}
+
+func TestSPN_SimplifyChains(t *testing.T) {
+	a, b, c := &Trm{Kth: 0, Value: 0}, &Trm{Kth: 0, Value: 1}, &Trm{Kth: 1, Value: 0}
+	s1 := &Sum{Edges: []SumEdge{{math.Log(0.3), a}, {math.Log(0.7), b}, {math.Inf(-1), b}}}
+	p1 := &Prd{Edges: []PrdEdge{{s1}}}
+	s2 := &Sum{Edges: []SumEdge{{0, p1}}}
+	s3 := &Sum{Edges: []SumEdge{{math.Log(0.5), s2}}}
+	p2 := &Prd{Edges: []PrdEdge{{c}}}
+	p3 := &Prd{Edges: []PrdEdge{{s3}, {p2}}}
+	zero := &Sum{Edges: []SumEdge{{math.Inf(-1), c}}}
+	p4 := &Prd{Edges: []PrdEdge{{zero}, {a}}}
+	root := &Sum{Edges: []SumEdge{{0, p3}, {0, p4}}}
+	spn := SPN{Nodes: []Node{a, b, c, s1, p1, s2, s3, p2, p3, zero, p4, root}, Schema: []int{2, 1}}
+	for i, n := range spn.Nodes {
+		n.SetID(i)
+	}
+	simple, before, after := spn.Simplify()
+	// The root is the product of c and a sum of a and b with the weights
+	// 0.15 and 0.35.
+	if want := (Size{Nodes: 5, Edges: 4}); after != want || before != (Size{Nodes: 12, Edges: 14}) {
+		t.Errorf("sizes %v %v, want %v", before, after, want)
+	}
+	checkSimplified(t, rand.New(rand.NewSource(1)), spn, simple)
+
+	spn.Nodes[len(spn.Nodes)-1] = &Sum{Edges: []SumEdge{{0, p4}}, id: len(spn.Nodes) - 1}
+	if simple, _, after := spn.Simplify(); after != (Size{Nodes: 1}) || !math.IsInf(simple.EvalX([]int{0, 0}), -1) {
+		t.Errorf("zero network simplifies to %v", after)
+	}
+}
@@ -0,0 +1,161 @@
+package maxspn
+
+import (
+	"context"
+	"math"
+	"math/rand"
+)
+
+// Stats counts the work done by a solver.
+type Stats struct {
+	Expanded    int // search nodes (or beam states) expanded
+	Pruned      int // subtrees cut off by the incumbent
+	Evals       int // forward passes over the network
+	Derivatives int // derivative passes over the network
+}
+
+// Result is the answer of a solver to a MAP query.
+type Result struct {
+	XP              // best assignment found and its log-probability
+	Upper   float64 // upper bound of the MAP value, +Inf if unknown
+	Optimal bool    // XP is proven to be a MAP assignment
+	Stats   Stats
+}
+
+// Gap returns the log-ratio of the upper bound to the value of the result:
+// 0 for a proven MAP assignment, +Inf if no bound is known.
+func (r Result) Gap() float64 {
+	return r.Upper - r.P
+}
+
+// Solver answers MAP queries on an SPN.
+type Solver interface {
+	// Solve maximizes over the query variables of q. The assignment of the
+	// result is over the variables of spn, as by q.Expand.
+	Solve(ctx context.Context, spn SPN, q Query) (Result, error)
+}
+
+// Method is a MAP method on an SPN all of whose variables are query
+// variables, such as the result of QuerySPN. It is a Solver, which runs the
+// method on the reduced QuerySPN. If ctx is done before the method starts,
+// the result has no assignment and no bound.
+type Method func(ctx context.Context, spn SPN) Result
+
+func (m Method) Solve(ctx context.Context, spn SPN, q Query) (Result, error) {
+	if err := q.Validate(spn.Schema); err != nil {
+		return Result{}, err
+	}
+	unsolved := Result{XP: XP{P: math.Inf(-1)}, Upper: math.Inf(1)}
+	if ctx.Err() != nil {
+		return unsolved, nil
+	}
+	ctx = remap(ctx, q.Expand)
+	reduced, ok := reduce(ctx, spn.QuerySPN(q))
+	if !ok {
+		return unsolved, nil
+	}
+	res := m(ctx, reduced)
+	if res.X != nil {
+		res.X = q.Expand(res.X)
+	}
+	return res, nil
+}
+
+// heuristic returns xp with the UpperBound of spn, counting the derivative
+// pass in st.
+func heuristic(ctx context.Context, spn SPN, xp XP, st Stats) Result {
+	st.Derivatives++
+	upper := UpperBound(ctx, spn)
+	return Result{XP: xp, Upper: upper, Optimal: upper <= xp.P, Stats: st}
+}
+
+// BT is the Best Tree method: the max-product tree of MaxMax.
+func BT() Method {
+	return func(ctx context.Context, spn SPN) Result {
+		x := MaxMax(spn)
+		return heuristic(ctx, spn, XP{x, spn.EvalX(x)}, Stats{Evals: 2})
+	}
+}
+
+// NG is the Normalized Greedy method of SumMax.
+func NG() Method {
+	return func(ctx context.Context, spn SPN) Result {
+		x := SumMax(spn)
+		return heuristic(ctx, spn, XP{x, spn.EvalX(x)}, Stats{Evals: 2})
+	}
+}
+
+// AMAP is the Argmax-Product method of MC.
+func AMAP() Method {
+	return func(ctx context.Context, spn SPN) Result {
+		return heuristic(ctx, spn, MC(ctx, spn), Stats{})
+	}
+}
+
+// BS is Beam Search from beamSize samples with the given beam size. Every
+// query draws its samples from a source seeded with seed.
+func BS(beamSize int, seed int64) Method {
+	return func(ctx context.Context, spn SPN) Result {
+		st := Stats{Evals: beamSize + 1}
+		r := rand.New(rand.NewSource(seed))
+		xp := beamSearchSerial(ctx, spn, PrbKSerial(ctx, spn, beamSize, r), beamSize, &st)
+		return heuristic(ctx, spn, xp, st)
+	}
+}
+
+// HC is Hill Climbing by HillClimb from the best tree of MaxMax.
+func HC() Method {
+	return func(ctx context.Context, spn SPN) Result {
+		return heuristic(ctx, spn, HillClimb(ctx, spn, MaxMax(spn)), Stats{Evals: 2})
+	}
+}
+
+// KBT is the K-Best Tree method: the best of the top k max-product trees.
+func KBT(k int) Method {
+	return func(ctx context.Context, spn SPN) Result {
+		xs := TopKMaxMax(ctx, spn, k)
+		if len(xs) == 0 {
+			return heuristic(ctx, spn, XP{P: math.NaN()}, Stats{})
+		}
+		return heuristic(ctx, spn, MaxXP(EvalXBatchSerial(spn, xs)), Stats{Evals: len(xs)})
+	}
+}
+
+// MP is the Marginal Pruning approach of ExactMP.
+func MP() Method {
+	return func(ctx context.Context, spn SPN) Result {
+		return exactMP(ctx, spn, math.Inf(-1))
+	}
+}
+
+// FC is the Forward Checking approach of ExactFC.
+func FC() Method {
+	return func(ctx context.Context, spn SPN) Result {
+		return exactFC(ctx, spn, math.Inf(-1))
+	}
+}
+
+// ORDERING is the Ordering approach of ExactORDERING.
+func ORDERING() Method {
+	return func(ctx context.Context, spn SPN) Result {
+		return exactORDERING(ctx, spn, math.Inf(-1))
+	}
+}
+
+// STAGE is the Stage approach of ExactSTAGE.
+func STAGE() Method {
+	return func(ctx context.Context, spn SPN) Result {
+		x := make([]int, len(spn.Schema))
+		for i := range x {
+			x[i] = -1
+		}
+		return exactSTAGE(ctx, spn, x, math.Inf(-1))
+	}
+}
+
+// EXACT is the multi-valued forward checking search of ExactSolver.
+func EXACT() Method {
+	return func(ctx context.Context, spn SPN) Result {
+		return exactSolver(ctx, spn)
+	}
+}
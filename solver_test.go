@@ -0,0 +1,170 @@
+package maxspn
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestMethod_Solve(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	exact := map[string]Method{
+		"MP": MP(), "FC": FC(), "ORDERING": ORDERING(), "STAGE": STAGE(), "EXACT": EXACT(),
+	}
+	heuristics := map[string]Method{
+		"BT": BT(), "NG": NG(), "AMAP": AMAP(), "BS": BS(4, 1), "HC": HC(), "KBT": KBT(10),
+	}
+	for times := 0; times < 20; times++ {
+		schema := make([]int, 10)
+		for i := range schema {
+			schema[i] = 2
+		}
+		spn := randomSPN(r, schema)
+		q := make(Query, len(schema))
+		for i := range q {
+			q[i] = []int{QueryVar, QueryVar, QueryVar, QueryVar, QueryVar, QueryVar, HiddenVar, 0, 1}[r.Intn(9)]
+		}
+		q[r.Intn(len(q))] = QueryVar
+		want := bruteForceMAP(spn, q)
+		check := func(name string, m Method) Result {
+			res, err := m.Solve(context.Background(), spn, q)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if p := spn.EvalX(res.X); math.Abs(p-res.P) > 1e-9 {
+				t.Errorf("%s %s: reported %f, assignment %v scores %f", name, q, res.P, res.X, p)
+			}
+			if res.P > want.P+1e-9 {
+				t.Errorf("%s %s: %f beats brute force %f", name, q, res.P, want.P)
+			}
+			if res.Upper < want.P-1e-9 {
+				t.Errorf("%s %s: upper bound %f below brute force %f", name, q, res.Upper, want.P)
+			}
+			return res
+		}
+		for name, m := range exact {
+			res := check(name, m)
+			if !res.Optimal || math.Abs(res.P-want.P) > 1e-9 {
+				t.Errorf("%s %s: got %f (optimal %v), want %f", name, q, res.P, res.Optimal, want.P)
+			}
+		}
+		for name, m := range heuristics {
+			check(name, m)
+		}
+	}
+}
+
+func TestMethod_SolveBadQuery(t *testing.T) {
+	spn := randomSPN(rand.New(rand.NewSource(1)), []int{2, 3})
+	for _, q := range []Query{{QueryVar}, {HiddenVar, HiddenVar}, {QueryVar, 3}, {QueryVar, -3}} {
+		if _, err := BT().Solve(context.Background(), spn, q); err == nil {
+			t.Errorf("Solve(%v) succeeded", q)
+		}
+	}
+}
+
+func TestMethod_SolveCanceled(t *testing.T) {
+	spn := randomSPN(rand.New(rand.NewSource(1)), []int{2, 3, 2, 4, 2, 2})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for name, m := range map[string]Method{
+		"MP": MP(), "FC": FC(), "ORDERING": ORDERING(), "STAGE": STAGE(), "EXACT": EXACT(),
+	} {
+		res, err := m.Solve(ctx, spn, mustParseQuery("??????"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Optimal || res.Stats.Expanded != 0 {
+			t.Errorf("%s: canceled search reported %+v", name, res)
+		}
+	}
+	if d := derivativeS(ctx, spn, X2Ass(make([]int, 6), spn.Schema)); d != nil {
+		t.Errorf("canceled derivative pass returned %v", d)
+	}
+}
+
+func TestWithProgress(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	schema := []int{2, 3, 2, 2, 4, 2, 2, 3, 2, 2, 2, 2}
+	for times := 0; times < 10; times++ {
+		spn := randomSPN(r, schema)
+		q := mustParseQuery("??*?1???0???")
+		for name, m := range map[string]Method{"MP": MP(), "FC": FC(), "STAGE": STAGE(), "EXACT": EXACT(), "BS": BS(4, 1), "HC": HC()} {
+			var ims []Improvement
+			ctx := WithProgress(context.Background(), func(im Improvement) {
+				ims = append(ims, im)
+			})
+			res, err := m.Solve(ctx, spn, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ims) == 0 {
+				t.Fatalf("%s: no improvement reported", name)
+			}
+			for i, im := range ims {
+				if i > 0 && (im.P <= ims[i-1].P || im.Elapsed < ims[i-1].Elapsed) {
+					t.Errorf("%s: improvement %d (%f at %v) after %f at %v", name, i, im.P, im.Elapsed, ims[i-1].P, ims[i-1].Elapsed)
+				}
+				if p := spn.EvalX(im.X); math.Abs(p-im.P) > 1e-9 {
+					t.Errorf("%s: reported %f, assignment %v scores %f", name, im.P, im.X, p)
+				}
+				if im.Upper < im.P {
+					t.Errorf("%s: upper bound %f below %f", name, im.Upper, im.P)
+				}
+			}
+			if last := ims[len(ims)-1]; last.P != res.P {
+				t.Errorf("%s: last improvement %f, result %f", name, last.P, res.P)
+			}
+		}
+	}
+}
+
+func TestResult_Gap(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	schema := []int{2, 3, 2, 2, 4, 2, 2, 3, 2, 2, 2, 2}
+	q := mustParseQuery("??*?1???0???")
+	for times := 0; times < 10; times++ {
+		spn := randomSPN(r, schema)
+		want := bruteForceMAP(spn, q)
+		for name, m := range map[string]Method{"MP": MP(), "FC": FC(), "ORDERING": ORDERING(), "STAGE": STAGE(), "EXACT": EXACT()} {
+			ctx, cancel := context.WithCancel(context.Background())
+			ctx = WithProgress(ctx, func(Improvement) { cancel() })
+			res, err := m.Solve(ctx, spn, q)
+			cancel()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.IsInf(res.Upper, 1) || res.Upper < want.P-1e-9 {
+				t.Errorf("%s: interrupted with upper bound %f, MAP %f", name, res.Upper, want.P)
+			}
+			if res.Gap() < -1e-9 || res.Optimal && res.P < want.P-1e-9 {
+				t.Errorf("%s: interrupted at %f with gap %f (optimal %v), MAP %f", name, res.P, res.Gap(), res.Optimal, want.P)
+			}
+		}
+	}
+}
+
+func TestMethod_SolveCanceledReduction(t *testing.T) {
+	spn := randomSPN(rand.New(rand.NewSource(4)), []int{2, 3, 2, 4, 2, 2, 3, 2})
+	q := mustParseQuery("??*?1???")
+	// Cancel before the query network is built, and at each check between
+	// the reduction passes.
+	for n := 1; n <= 4; n++ {
+		for name, m := range map[string]Method{"BT": BT(), "EXACT": EXACT()} {
+			ctx, cancel := context.WithCancel(context.Background())
+			c := &cancelAfter{ctx, cancel, n}
+			res, err := m.Solve(c, spn, q)
+			cancel()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.n != 0 {
+				t.Fatalf("%s: %d checks of the context left", name, c.n)
+			}
+			if res.X != nil || res.Stats != (Stats{}) || !math.IsInf(res.Upper, 1) {
+				t.Errorf("%s canceled at check %d: got %+v, want no assignment", name, n, res)
+			}
+		}
+	}
+}
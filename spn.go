@@ -1,8 +1,13 @@
-package main
+// Package maxspn implements sum-product networks (SPNs) and arithmetic
+// circuits (ACs): model I/O, evaluation, derivatives and MAP solvers.
+//
+// The experiment harness lives in cmd/maxspn.
+package maxspn
 
 import (
-	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math"
@@ -115,8 +120,16 @@ func (spn SPN) EvalX(x []int) float64 {
 }
 
 func (spn SPN) Eval(ass [][]float64) []float64 {
+	return spn.evalContext(context.Background(), ass)
+}
+
+// evalContext is Eval that returns nil if ctx is done before the pass ends.
+func (spn SPN) evalContext(ctx context.Context, ass [][]float64) []float64 {
 	val := make([]float64, len(spn.Nodes))
-	for _, n := range spn.Nodes {
+	for i, n := range spn.Nodes {
+		if canceled(ctx, i) {
+			return nil
+		}
 		switch n := n.(type) {
 		case *Trm:
 			val[n.ID()] = math.Log(ass[n.Kth][n.Value])
@@ -135,6 +148,11 @@ func (spn SPN) Eval(ass [][]float64) []float64 {
 	return val
 }
 
+// canceled polls ctx once every 1024 nodes of a pass over a network.
+func canceled(ctx context.Context, i int) bool {
+	return i&1023 == 0 && ctx.Err() != nil
+}
+
 type Stat struct {
 	Sum float64
 	Avg float64
@@ -279,61 +297,90 @@ func (spn SPN) Save(filename string) {
 }
 
 func LoadSPN(filename string) SPN {
-	bs, err := ioutil.ReadFile(filename)
+	file, err := os.Open(filename)
 	if err != nil {
 		log.Fatal(err)
 	}
-	bss := bytes.Split(bs, []byte("\n"))
-	end := len(bss) - 1
-	for string(bss[end]) != "EOF" {
-		end--
+	defer file.Close()
+	spn, err := ReadSPN(file)
+	if err != nil {
+		log.Fatalf("%s: %v\n", filename, err)
 	}
+	return spn
+}
 
-	scs := bytes.Split(bss[0][1:len(bss[0])-1], []byte(" "))
-	schema := make([]int, len(scs))
-	for i, s := range scs {
-		schema[i] = parseInt(string(s))
+// ReadSPN reads an SPN in the format written by Save. Nodes must be listed in
+// topological order, children before their parents.
+func ReadSPN(r io.Reader) (SPN, error) {
+	ms := newModelScanner(r)
+	schema, err := ms.schema()
+	if err != nil {
+		return SPN{}, err
 	}
-
-	bss = bss[1:end]
-	nodes := make([]Node, len(bss))
-	for i, ln := range bss {
-		bs := bytes.Split(ln, []byte(" "))
-		switch string(bs[0]) {
+	nodes := []Node{}
+	for {
+		bs, done, err := ms.next()
+		if err != nil {
+			return SPN{}, err
+		}
+		if done {
+			break
+		}
+		if len(bs) == 0 {
+			return SPN{}, ms.errorf("empty line")
+		}
+		i := len(nodes)
+		switch bs[0] {
 		case "v":
-			nodes[i] = &Trm{
-				Kth:   parseInt(string(bs[1])),
-				Value: parseInt(string(bs[2])),
-				id:    i,
+			kth, value, err := ms.variable(bs[1:], schema)
+			if err != nil {
+				return SPN{}, err
 			}
+			nodes = append(nodes, &Trm{Kth: kth, Value: value, id: i})
 		case "+":
+			if len(bs) == 1 || len(bs)%2 == 0 {
+				return SPN{}, ms.errorf("sum node needs (child, weight) pairs, got %d arguments", len(bs)-1)
+			}
 			es := make([]SumEdge, len(bs)/2)
 			for j := 1; j < len(bs); j += 2 {
-				node := nodes[parseInt(string(bs[j]))]
-				weight := parseFloat(string(bs[j+1]))
+				c, err := ms.child(bs[j], i)
+				if err != nil {
+					return SPN{}, err
+				}
+				weight, err := ms.float(bs[j+1])
+				if err != nil {
+					return SPN{}, err
+				}
+				if math.IsNaN(weight) || math.IsInf(weight, 1) {
+					return SPN{}, ms.errorf("log weight %v out of range", weight)
+				}
 				es[j/2] = SumEdge{
 					Weight: weight,
-					Node:   node,
+					Node:   nodes[c],
 				}
 			}
-			nodes[i] = &Sum{
-				Edges: es,
-				id:    i,
-			}
+			nodes = append(nodes, &Sum{Edges: es, id: i})
 		case "*":
+			if len(bs) == 1 {
+				return SPN{}, ms.errorf("product node without children")
+			}
 			es := make([]PrdEdge, len(bs)-1)
 			for j, v := range bs[1:] {
-				es[j] = PrdEdge{
-					Node: nodes[parseInt(string(v))],
+				c, err := ms.child(v, i)
+				if err != nil {
+					return SPN{}, err
 				}
+				es[j] = PrdEdge{Node: nodes[c]}
 			}
-			nodes[i] = &Prd{
-				Edges: es,
-				id:    i,
-			}
+			nodes = append(nodes, &Prd{Edges: es, id: i})
+		default:
+			return SPN{}, ms.errorf("unknown node type %q", bs[0])
 		}
 	}
-	return SPN{nodes, schema}
+	if len(nodes) == 0 {
+		return SPN{}, ms.errorf("no nodes")
+	}
+	return SPN{nodes, schema}, nil
 }
 
 func formatSchema(data []byte, schema []int) []byte {
@@ -419,20 +466,22 @@ func plotDFS(n Node, from string, vis map[int]struct{}, dep []int, treeDepth int
 	return nid
 }
 
-func (spn SPN) QuerySPN(q []byte) SPN {
+// QuerySPN returns the network over the query variables of q, renumbered in
+// order, with the evidence of q fixed and its hidden variables summed out.
+func (spn SPN) QuerySPN(q Query) SPN {
 	idMap := map[int]int{}
 	varCnt := 0
 	schema := make([]int, 0, len(spn.Schema))
 	for i, c := range q {
-		if c == '?' {
+		if c == QueryVar {
 			idMap[i] = varCnt
 			varCnt++
 			schema = append(schema, spn.Schema[i])
 		}
 	}
 	if varCnt == 0 {
-		log.Println(string(q))
-		log.Fatal("QuerySPN no '?'")
+		log.Println(q)
+		log.Fatal("QuerySPN no query variable")
 	}
 	nn := len(spn.Nodes)
 	ns := make([]Node, nn+1)
@@ -440,14 +489,11 @@ func (spn SPN) QuerySPN(q []byte) SPN {
 	for i, n := range spn.Nodes {
 		switch n := n.(type) {
 		case *Trm:
-			if q[n.Kth] == '?' {
+			if q[n.Kth] == QueryVar {
 				ns[i] = &Trm{Kth: idMap[n.Kth], Value: n.Value}
 			} else {
 				w := math.Inf(-1)
-				if n.Value == 0 && (q[n.Kth] == '0' || q[n.Kth] == '*') {
-					w = 0
-				}
-				if n.Value == 1 && (q[n.Kth] == '1' || q[n.Kth] == '*') {
+				if q[n.Kth] == HiddenVar || q[n.Kth] == n.Value {
 					w = 0
 				}
 				we[i] = w
@@ -492,83 +538,18 @@ func (spn SPN) QuerySPN(q []byte) SPN {
 	return SPN{nodes, schema}
 }
 
-func (spn SPN) StageSPN(q []int) SPN {
-	idMap := map[int]int{}
-	varCnt := 0
-	schema := make([]int, 0, len(spn.Schema))
-	for i, c := range q {
-		if c == -1 {
-			idMap[i] = varCnt
-			varCnt++
-			schema = append(schema, spn.Schema[i])
-		}
-	}
-	if varCnt == 0 {
-		log.Println(q)
-		log.Fatal("q has no -1")
-	}
-	nn := len(spn.Nodes)
-	ns := make([]Node, nn+1)
-	we := make([]float64, nn)
-	for i, n := range spn.Nodes {
-		switch n := n.(type) {
-		case *Trm:
-			if q[n.Kth] == -1 {
-				ns[i] = &Trm{Kth: idMap[n.Kth], Value: n.Value}
-			} else {
-				w := math.Inf(-1)
-				if n.Value == 0 && q[n.Kth] == 0 {
-					w = 0
-				}
-				if n.Value == 1 && q[n.Kth] == 1 {
-					w = 0
-				}
-				we[i] = w
-			}
-		case *Sum:
-			if ns[n.Edges[0].Node.ID()] == nil {
-				we[i] = logSumExpF(len(n.Edges), func(k int) float64 {
-					return n.Edges[k].Weight + we[n.Edges[k].Node.ID()]
-				})
-			} else {
-				es := make([]SumEdge, len(n.Edges))
-				for j, e := range n.Edges {
-					es[j] = SumEdge{e.Weight + we[e.Node.ID()], ns[e.Node.ID()]}
-				}
-				ns[i] = &Sum{Edges: es}
-			}
-		case *Prd:
-			es := make([]PrdEdge, 0, len(n.Edges))
-			w := 0.0
-			for _, e := range n.Edges {
-				w += we[e.Node.ID()]
-				if ns[e.Node.ID()] != nil {
-					es = append(es, PrdEdge{ns[e.Node.ID()]})
-				}
-			}
-			we[i] = w
-			if len(es) > 0 {
-				ns[i] = &Prd{Edges: es}
-			}
-		}
-	}
-	if _, ok := ns[nn-1].(*Sum); !ok {
-		ns[nn] = &Sum{Edges: []SumEdge{{we[nn-1], ns[nn-1]}}}
-	}
-	nodes := make([]Node, 0, nn+1)
-	for _, n := range ns {
-		if n != nil {
-			n.SetID(len(nodes))
-			nodes = append(nodes, n)
-		}
-	}
-	return SPN{nodes, schema}
+// StageSPN is QuerySPN for a partial assignment q, with -1 for the free
+// variables.
+func (spn SPN) StageSPN(q Query) SPN {
+	return spn.QuerySPN(q)
 }
 
-func (spn SPN) FastStageSPN(q []int) SPN {
+// FastStageSPN is StageSPN that keeps the node IDs and the variables of spn,
+// sharing the nodes that q does not affect.
+func (spn SPN) FastStageSPN(q Query) SPN {
 	varCnt := 0
 	for _, c := range q {
-		if c == -1 {
+		if c == QueryVar {
 			varCnt++
 		}
 	}
@@ -583,14 +564,11 @@ func (spn SPN) FastStageSPN(q []int) SPN {
 	for i, n := range spn.Nodes {
 		switch n := n.(type) {
 		case *Trm:
-			if q[n.Kth] == -1 {
+			if q[n.Kth] == QueryVar {
 				ns[i] = n
 			} else {
 				w := math.Inf(-1)
-				if n.Value == 0 && q[n.Kth] == 0 {
-					w = 0
-				}
-				if n.Value == 1 && q[n.Kth] == 1 {
+				if q[n.Kth] == HiddenVar || n.Value == q[n.Kth] {
 					w = 0
 				}
 				we[i] = w
@@ -653,3 +631,50 @@ func (spn SPN) FastStageSPN(q []int) SPN {
 	}
 	return SPN{ns, spn.Schema}
 }
+
+// Normalize returns a locally normalized network equivalent to spn, whose
+// sum weights each sum to 1, and the log partition function of spn. The
+// returned network evaluates to the value of spn minus the log partition
+// function. Sum nodes that evaluate to zero everywhere get uniform weights.
+func (spn SPN) Normalize() (SPN, float64) {
+	prt := partition(spn)
+	ns := make([]Node, len(spn.Nodes))
+	for i, n := range spn.Nodes {
+		switch n := n.(type) {
+		case *Trm:
+			ns[i] = &Trm{Kth: n.Kth, Value: n.Value, id: i}
+		case *Sum:
+			es := make([]SumEdge, len(n.Edges))
+			for j, e := range n.Edges {
+				w := e.Weight + prt[e.Node.ID()] - prt[i]
+				if math.IsInf(prt[i], -1) {
+					w = -math.Log(float64(len(n.Edges)))
+				}
+				es[j] = SumEdge{w, ns[e.Node.ID()]}
+			}
+			ns[i] = &Sum{Edges: es, id: i}
+		case *Prd:
+			es := make([]PrdEdge, len(n.Edges))
+			for j, e := range n.Edges {
+				es[j] = PrdEdge{ns[e.Node.ID()]}
+			}
+			ns[i] = &Prd{Edges: es, id: i}
+		}
+	}
+	return SPN{ns, spn.Schema}, prt[len(prt)-1]
+}
+
+// LogWeightSums returns, for every node, the log of the sum of its weights:
+// how far a sum node is from normalized, 0 for a normalized one, and 0 for
+// the other nodes.
+func (spn SPN) LogWeightSums() []float64 {
+	res := make([]float64, len(spn.Nodes))
+	for i, n := range spn.Nodes {
+		if n, ok := n.(*Sum); ok {
+			res[i] = logSumExpF(len(n.Edges), func(k int) float64 {
+				return n.Edges[k].Weight
+			})
+		}
+	}
+	return res
+}
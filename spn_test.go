@@ -1,9 +1,11 @@
-package main
+package maxspn
 
 import (
 	"math"
 	"math/rand"
 	"os/exec"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -76,7 +78,7 @@ func TestSPN_Plot(t *testing.T) {
 
 func TestSPN_QuerySPN(t *testing.T) {
 	spn := LoadSPN(LR_SPN + "nltcs")
-	qSPN := spn.QuerySPN([]byte("????????????????"))
+	qSPN := spn.QuerySPN(mustParseQuery("????????????????"))
 	for times := 0; times < 100; times++ {
 		as := make([][]float64, len(spn.Schema))
 		for i := range as {
@@ -96,7 +98,7 @@ func TestSPN_QuerySPN(t *testing.T) {
 
 func TestSPN_QuerySPN2(t *testing.T) {
 	spn := LoadSPN(LR_SPN + "nltcs")
-	q := []byte("??????????******")
+	q := mustParseQuery("??????????******")
 	qSPN := spn.QuerySPN(q)
 	for times := 0; times < 100; times++ {
 		as := make([][]float64, len(spn.Schema))
@@ -104,7 +106,7 @@ func TestSPN_QuerySPN2(t *testing.T) {
 			as[i] = make([]float64, 2)
 			as[i][0] = float64(rand.Intn(2))
 			as[i][1] = 1 // float64(rand.Intn(2))
-			if q[i] == '*' {
+			if q[i] == HiddenVar {
 				as[i][0] = 1
 				as[i][1] = 1
 			}
@@ -116,3 +118,154 @@ func TestSPN_QuerySPN2(t *testing.T) {
 		}
 	}
 }
+
+const tinySPN = `(2 3)
+v 0 0
+v 0 1
+v 1 0
+v 1 1
+v 1 2
++ 2 -0.5 3 -1.5 4 -2
+* 0 5
+* 1 2
++ 6 -0.2 7 -1.7
+EOF
+`
+
+func TestReadSPN(t *testing.T) {
+	spn, err := ReadSPN(strings.NewReader(tinySPN))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spn.Nodes) != 9 || !reflect.DeepEqual(spn.Schema, []int{2, 3}) {
+		t.Fatalf("got %d nodes, schema %v", len(spn.Nodes), spn.Schema)
+	}
+	bad := []struct {
+		data string
+		line int
+	}{
+		{"2 3\nv 0 0\nEOF\n", 1},
+		{"(2 0)\nv 0 0\nEOF\n", 1},
+		{"(2 3)\nv 0 0\nv 1 3\nEOF\n", 3},
+		{"(2 3)\nv 2 0\nEOF\n", 2},
+		{"(2 3)\nv 0 0\nv 0 1\n+ 0 -1 1\nEOF\n", 4},
+		{"(2 3)\nv 0 0\n+ 0 -1 1 -1\nEOF\n", 3},
+		{"(2 3)\nv 0 0\n* 0 0 2\nEOF\n", 3},
+		{"(2 3)\nv 0 0\n+ 0 NaN\nEOF\n", 3},
+		{"(2 3)\nv 0 0\nx 0\nEOF\n", 3},
+		{"(2 3)\nv 0 0\n", 3},
+	}
+	for _, b := range bad {
+		_, err := ReadSPN(strings.NewReader(b.data))
+		pe, ok := err.(*ParseError)
+		if !ok || pe.Line != b.line {
+			t.Errorf("ReadSPN(%q) = %v, want error at line %d", b.data, err, b.line)
+		}
+	}
+}
+
+func TestSPN_Normalize(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for times := 0; times < 10; times++ {
+		spn := randomSPN(r, []int{2, 3, 2, 2, 3})
+		spn = spn.QuerySPN(mustParseQuery("?1?*?"))
+		norm, logZ := spn.Normalize()
+		if rep := norm.Validate(); !rep.Valid() || !rep.Normalized() {
+			t.Fatalf("normalized network: %+v", rep)
+		}
+		for i, d := range norm.LogWeightSums() {
+			if math.Abs(d) > 1e-9 {
+				t.Errorf("node %d: log weight sum %g", i, d)
+			}
+		}
+		if z := partition(spn); math.Abs(z[len(z)-1]-logZ) > 1e-9 {
+			t.Errorf("log partition %f, want %f", logZ, z[len(z)-1])
+		}
+		for x := []int{0, 0, 0}; x[2] < 3; {
+			if p, want := norm.EvalX(x), spn.EvalX(x)-logZ; math.Abs(p-want) > 1e-9 {
+				t.Errorf("%v: normalized %f, want %f", x, p, want)
+			}
+			for k := 0; k < len(x); k++ {
+				x[k]++
+				if x[k] < norm.Schema[k] || k == len(x)-1 {
+					break
+				}
+				x[k] = 0
+			}
+		}
+	}
+}
+
+// randomSPN returns a random complete and decomposable SPN over schema.
+func randomSPN(r *rand.Rand, schema []int) SPN {
+	spn := SPN{Schema: schema}
+	add := func(n Node) Node {
+		n.SetID(len(spn.Nodes))
+		spn.Nodes = append(spn.Nodes, n)
+		return n
+	}
+	trms := make([][]Node, len(schema))
+	for i, c := range schema {
+		for v := 0; v < c; v++ {
+			trms[i] = append(trms[i], add(&Trm{Kth: i, Value: v}))
+		}
+	}
+	var build func(scope []int, depth int) Node
+	build = func(scope []int, depth int) Node {
+		sum := &Sum{}
+		if len(scope) == 1 {
+			for _, t := range trms[scope[0]] {
+				sum.Edges = append(sum.Edges, SumEdge{math.Log(r.Float64()), t})
+			}
+			return add(sum)
+		}
+		for k := 1 + r.Intn(3); k > 0 || depth == 0 && len(sum.Edges) < 2; k-- {
+			perm := r.Perm(len(scope))
+			cut := 1 + r.Intn(len(scope)-1)
+			left := make([]int, 0, cut)
+			right := make([]int, 0, len(scope)-cut)
+			for j, p := range perm {
+				if j < cut {
+					left = append(left, scope[p])
+				} else {
+					right = append(right, scope[p])
+				}
+			}
+			prd := &Prd{Edges: []PrdEdge{{build(left, depth+1)}, {build(right, depth+1)}}}
+			sum.Edges = append(sum.Edges, SumEdge{math.Log(r.Float64()), add(prd)})
+		}
+		return add(sum)
+	}
+	scope := make([]int, len(schema))
+	for i := range scope {
+		scope[i] = i
+	}
+	build(scope, 0)
+	return spn
+}
+
+// bruteForceMAP maximizes over the query variables of q by enumeration.
+func bruteForceMAP(spn SPN, q Query) XP {
+	x := q.Expand(make([]int, len(q.QueryVars())))
+	best := XP{P: math.Inf(-1)}
+	var enum func(i int)
+	enum = func(i int) {
+		if i == len(q) {
+			if p := spn.EvalX(x); best.P < p {
+				best = XP{append([]int(nil), x...), p}
+			}
+			return
+		}
+		if q[i] != QueryVar {
+			enum(i + 1)
+			return
+		}
+		for v := 0; v < spn.Schema[i]; v++ {
+			x[i] = v
+			enum(i + 1)
+		}
+		x[i] = 0
+	}
+	enum(0)
+	return best
+}
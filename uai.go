@@ -0,0 +1,177 @@
+package maxspn
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// UAI competition files are whitespace-separated integers. An evidence file
+// of the older format lists the number of samples followed, for every
+// sample, by the number of observed variables and their (variable, value)
+// pairs; the later format holds a single sample without the sample count. A
+// MAP query file lists the number of query variables followed by the
+// variables.
+
+// ReadUAIEvidence reads a UAI .evid file over the variables of schema. It
+// returns one assignment per evidence sample, with -1 for the variables that
+// are not observed. A file of exactly the length of a single sample whose
+// count is its first number reads as a single sample if it parses as one.
+func ReadUAIEvidence(r io.Reader, schema []int) ([][]int, error) {
+	is, err := readUAIInts(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(is) == 0 {
+		return nil, fmt.Errorf("empty evidence file")
+	}
+	if 1+2*is[0] != len(is) {
+		return uaiSamples(is, schema)
+	}
+	// The later single-sample format, unless only the older one parses.
+	evid, _, err := uaiSample(is, schema)
+	if err != nil {
+		evids, err2 := uaiSamples(is, schema)
+		if err2 != nil {
+			return nil, err
+		}
+		return evids, nil
+	}
+	return [][]int{evid}, nil
+}
+
+func uaiSamples(is []int, schema []int) ([][]int, error) {
+	if is[0] < 0 || is[0] > len(is) {
+		return nil, fmt.Errorf("bad sample count %d", is[0])
+	}
+	evids := make([][]int, is[0])
+	is = is[1:]
+	for i := range evids {
+		if len(is) == 0 {
+			return nil, fmt.Errorf("evidence file has %d samples, want %d", i, len(evids))
+		}
+		evid, n, err := uaiSample(is, schema)
+		if err != nil {
+			return nil, fmt.Errorf("evidence sample %d: %v", i, err)
+		}
+		evids[i] = evid
+		is = is[n:]
+	}
+	if len(is) != 0 {
+		return nil, fmt.Errorf("%d trailing numbers after the evidence samples", len(is))
+	}
+	return evids, nil
+}
+
+// uaiSample parses one evidence sample at the start of is and returns the
+// number of integers it takes.
+func uaiSample(is []int, schema []int) ([]int, int, error) {
+	cnt := is[0]
+	if cnt < 0 || 1+2*cnt > len(is) {
+		return nil, 0, fmt.Errorf("bad evidence count %d", cnt)
+	}
+	evid := make([]int, len(schema))
+	for i := range evid {
+		evid[i] = -1
+	}
+	for k := 0; k < cnt; k++ {
+		v, val := is[1+2*k], is[2+2*k]
+		if v < 0 || v >= len(schema) {
+			return nil, 0, fmt.Errorf("variable %d out of schema range [0, %d)", v, len(schema))
+		}
+		if val < 0 || val >= schema[v] {
+			return nil, 0, fmt.Errorf("value %d of variable %d out of schema range [0, %d)", val, v, schema[v])
+		}
+		evid[v] = val
+	}
+	return evid, 1 + 2*cnt, nil
+}
+
+// ReadUAIQuery reads the MAP variables of a UAI .query file.
+func ReadUAIQuery(r io.Reader, schema []int) ([]int, error) {
+	is, err := readUAIInts(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(is) == 0 || is[0] != len(is)-1 {
+		return nil, fmt.Errorf("query file has %d numbers, want a count and that many variables", len(is))
+	}
+	vars := is[1:]
+	for _, v := range vars {
+		if v < 0 || v >= len(schema) {
+			return nil, fmt.Errorf("variable %d out of schema range [0, %d)", v, len(schema))
+		}
+	}
+	return vars, nil
+}
+
+// UAIQuery returns the query of the evidence evid and the MAP variables vars:
+// the variables of vars are query variables, the other unobserved ones are
+// hidden. If vars is nil, it is the
+// MPE query of all the unobserved variables.
+func UAIQuery(evid []int, vars []int) (Query, error) {
+	q := make(Query, len(evid))
+	for i, v := range evid {
+		switch {
+		case v == -1 && vars == nil:
+			q[i] = QueryVar
+		case v == -1:
+			q[i] = HiddenVar
+		default:
+			q[i] = v
+		}
+	}
+	for _, v := range vars {
+		if evid[v] != -1 {
+			return nil, fmt.Errorf("MAP variable %d is observed", v)
+		}
+		q[v] = QueryVar
+	}
+	return q, nil
+}
+
+// WriteUAISolution writes a UAI solution file of task "MPE" or "MAP" with one
+// line per assignment of xs: the number of variables and their values, all
+// of them for "MPE" and those of vars, in order, for "MAP".
+func WriteUAISolution(w io.Writer, task string, xs [][]int, vars []int) error {
+	if task != "MPE" && task != "MAP" {
+		return fmt.Errorf("unknown UAI task %q", task)
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%s\n%d\n", task, len(xs))
+	for i, x := range xs {
+		if x == nil {
+			return fmt.Errorf("no assignment for sample %d", i)
+		}
+		vs := x
+		if task == "MAP" {
+			vs = make([]int, len(vars))
+			for i, v := range vars {
+				vs[i] = x[v]
+			}
+		}
+		data := strconv.AppendInt(nil, int64(len(vs)), 10)
+		for _, v := range vs {
+			data = append(data, ' ')
+			data = strconv.AppendInt(data, int64(v), 10)
+		}
+		data = append(data, '\n')
+		bw.Write(data)
+	}
+	return bw.Flush()
+}
+
+func readUAIInts(r io.Reader) ([]int, error) {
+	sc := bufio.NewScanner(r)
+	sc.Split(bufio.ScanWords)
+	is := []int{}
+	for sc.Scan() {
+		i, err := strconv.Atoi(sc.Text())
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q", sc.Text())
+		}
+		is = append(is, i)
+	}
+	return is, sc.Err()
+}
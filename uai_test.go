@@ -0,0 +1,95 @@
+package maxspn
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadUAIEvidence(t *testing.T) {
+	schema := []int{2, 3, 2, 2}
+	for _, test := range []struct {
+		in   string
+		want [][]int
+		err  string
+	}{
+		{"2\n2 0 1 1 2\n0\n", [][]int{{1, 2, -1, -1}, {-1, -1, -1, -1}}, ""},
+		{"1 3 1\n", [][]int{{-1, -1, -1, 1}}, ""},
+		{"2 3 1 0 1", [][]int{{1, -1, -1, 1}}, ""},
+		// Also two samples, the second empty, but read as a single one.
+		{"2 1 0 0 0", [][]int{{0, 0, -1, -1}}, ""},
+		{"2 1 3 1 0", [][]int{{-1, -1, -1, 1}, {-1, -1, -1, -1}}, ""},
+		{"1 1 3", nil, "value 3 of variable 1"},
+		{"1\n1 1 3\n", nil, "value 3 of variable 1"},
+		{"1\n1 4 0\n", nil, "variable 4"},
+		{"2\n1 0 1\n", nil, "1 samples, want 2"},
+		{"1 x", nil, "bad number"},
+		{"", nil, "empty"},
+	} {
+		got, err := ReadUAIEvidence(strings.NewReader(test.in), schema)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: got error %v, want %q", test.in, err, test.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %v, %v, want %v", test.in, got, err, test.want)
+		}
+	}
+}
+
+func TestUAI(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	schema := []int{2, 3, 2, 2, 3, 2}
+	spn := randomSPN(r, schema)
+	vars, err := ReadUAIQuery(strings.NewReader("2\n4 1\n"), schema)
+	if err != nil || !reflect.DeepEqual(vars, []int{4, 1}) {
+		t.Fatalf("query: got %v, %v", vars, err)
+	}
+	evids, err := ReadUAIEvidence(strings.NewReader("2\n1 0 1\n2 2 0 5 1\n"), schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		task string
+		vars []int
+		qs   []string
+	}{
+		{"MAP", vars, []string{"1,?,*,*,?,*", "*,?,0,*,?,1"}},
+		{"MPE", nil, []string{"1,?,?,?,?,?", "?,?,0,?,?,1"}},
+	} {
+		xs := make([][]int, len(evids))
+		for i, evid := range evids {
+			q, err := UAIQuery(evid, test.vars)
+			if err != nil || q.String() != test.qs[i] {
+				t.Fatalf("%s query %d: got %s, %v, want %s", test.task, i, q, err, test.qs[i])
+			}
+			res, err := EXACT().Solve(context.Background(), spn, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			xs[i] = res.X
+		}
+		var buf bytes.Buffer
+		if err := WriteUAISolution(&buf, test.task, xs, test.vars); err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		if len(lines) != 4 || lines[0] != test.task || lines[1] != "2" {
+			t.Fatalf("%s solution:\n%s", test.task, buf.String())
+		}
+		if test.task == "MPE" && !strings.HasPrefix(lines[2], "6 1 ") {
+			t.Errorf("MPE solution keeps evidence: %q", lines[2])
+		}
+		if test.task == "MAP" && len(strings.Fields(lines[3])) != 3 {
+			t.Errorf("MAP solution lists 2 variables: %q", lines[3])
+		}
+	}
+	if _, err := UAIQuery([]int{0, -1}, []int{0}); err == nil {
+		t.Errorf("observed MAP variable accepted")
+	}
+}
@@ -0,0 +1,192 @@
+package maxspn
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// normTolerance is the largest log-sum of the weights of a sum node that is
+// still taken as normalized.
+const normTolerance = 1e-6
+
+// Report is the result of SPN.Validate. Each list holds node IDs in
+// increasing order.
+type Report struct {
+	Misordered      []int // nodes whose ID is not their index or whose children do not precede them
+	BadTerminals    []int // terminals whose variable or value is outside the schema
+	Roots           []int // nodes that are not a child of any node
+	Incomplete      []int // sum nodes without children or whose children differ in scope
+	NonDecomposable []int // product nodes whose children share a variable
+	Unnormalized    []int // sum nodes whose weights do not sum to 1
+	NonSelective    []int // sum nodes not proven selective
+}
+
+// Ordered reports whether the nodes are in topological order with the root
+// last, as evaluation and every solver assume.
+func (r Report) Ordered() bool {
+	return len(r.Misordered) == 0 && len(r.Roots) == 1
+}
+
+// Valid reports whether the SPN is ordered, well-formed, complete and
+// decomposable, so that it computes a distribution up to normalization.
+func (r Report) Valid() bool {
+	return r.Ordered() && len(r.BadTerminals) == 0 && len(r.Incomplete) == 0 && len(r.NonDecomposable) == 0
+}
+
+// Normalized reports whether the weights of every sum node sum to 1.
+func (r Report) Normalized() bool {
+	return len(r.Unnormalized) == 0
+}
+
+// Selective reports whether every sum node is selective (deterministic): at
+// most one of its children is non-zero at any complete assignment. For a
+// valid selective SPN, the max-product tree of MaxMax is a MAP assignment.
+func (r Report) Selective() bool {
+	return len(r.NonSelective) == 0
+}
+
+// Err returns nil if the SPN is valid, and otherwise an error describing its
+// first problem.
+func (r Report) Err() error {
+	switch {
+	case len(r.Misordered) > 0:
+		return fmt.Errorf("node %d is out of topological order", r.Misordered[0])
+	case len(r.Roots) != 1:
+		return fmt.Errorf("%d roots %v, want 1", len(r.Roots), r.Roots)
+	case len(r.BadTerminals) > 0:
+		return fmt.Errorf("terminal %d is outside the schema", r.BadTerminals[0])
+	case len(r.Incomplete) > 0:
+		return fmt.Errorf("sum node %d is not complete", r.Incomplete[0])
+	case len(r.NonDecomposable) > 0:
+		return fmt.Errorf("product node %d is not decomposable", r.NonDecomposable[0])
+	}
+	return nil
+}
+
+// Validate checks the structure of spn. The scope checks run only if the
+// nodes are in topological order; a sum node is proven selective if every
+// pair of its children admits disjoint sets of values of some variable.
+func (spn SPN) Validate() Report {
+	r := Report{}
+	child := make([]bool, len(spn.Nodes))
+	for i, n := range spn.Nodes {
+		ordered := n.ID() == i
+		for _, c := range children(n) {
+			if c.ID() < 0 || c.ID() >= i || spn.Nodes[c.ID()] != c {
+				ordered = false
+			} else {
+				child[c.ID()] = true
+			}
+		}
+		if !ordered {
+			r.Misordered = append(r.Misordered, i)
+		}
+	}
+	for i := range spn.Nodes {
+		if !child[i] {
+			r.Roots = append(r.Roots, i)
+		}
+	}
+	if len(r.Misordered) > 0 {
+		return r
+	}
+
+	sums := spn.LogWeightSums()
+	// scope[i] is the set of variables of node i, and vals[i][k] the set of
+	// values of variable k at which node i can be non-zero.
+	scope := make([]*big.Int, len(spn.Nodes))
+	vals := make([]map[int]*big.Int, len(spn.Nodes))
+	for i, n := range spn.Nodes {
+		scope[i] = new(big.Int)
+		vals[i] = map[int]*big.Int{}
+		switch n := n.(type) {
+		case *Trm:
+			if n.Kth < 0 || n.Kth >= len(spn.Schema) || n.Value < 0 || n.Value >= spn.Schema[n.Kth] {
+				r.BadTerminals = append(r.BadTerminals, i)
+				continue
+			}
+			scope[i].SetBit(scope[i], n.Kth, 1)
+			vals[i][n.Kth] = new(big.Int).SetBit(new(big.Int), n.Value, 1)
+		case *Sum:
+			for j, e := range n.Edges {
+				c := e.Node.ID()
+				if j == 0 {
+					scope[i].Set(scope[c])
+				} else if scope[i].Cmp(scope[c]) != 0 {
+					r.Incomplete = appendOnce(r.Incomplete, i)
+				}
+				for k, v := range vals[c] {
+					if vals[i][k] == nil {
+						vals[i][k] = new(big.Int)
+					}
+					vals[i][k].Or(vals[i][k], v)
+				}
+			}
+			if len(n.Edges) == 0 {
+				r.Incomplete = append(r.Incomplete, i)
+			}
+			if math.Abs(sums[i]) > normTolerance {
+				r.Unnormalized = append(r.Unnormalized, i)
+			}
+			if !selective(n, vals) {
+				r.NonSelective = append(r.NonSelective, i)
+			}
+		case *Prd:
+			for _, e := range n.Edges {
+				c := e.Node.ID()
+				if new(big.Int).And(scope[i], scope[c]).Sign() != 0 {
+					r.NonDecomposable = appendOnce(r.NonDecomposable, i)
+				}
+				scope[i].Or(scope[i], scope[c])
+				for k, v := range vals[c] {
+					vals[i][k] = v
+				}
+			}
+		}
+	}
+	return r
+}
+
+// selective reports whether every two children of n have disjoint value
+// sets of a variable they share.
+func selective(n *Sum, vals []map[int]*big.Int) bool {
+	for a := range n.Edges {
+		for b := a + 1; b < len(n.Edges); b++ {
+			va, vb := vals[n.Edges[a].Node.ID()], vals[n.Edges[b].Node.ID()]
+			disjoint := false
+			for k, v := range va {
+				if w, ok := vb[k]; ok && new(big.Int).And(v, w).Sign() == 0 {
+					disjoint = true
+					break
+				}
+			}
+			if !disjoint {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func children(n Node) []Node {
+	var cs []Node
+	switch n := n.(type) {
+	case *Sum:
+		for _, e := range n.Edges {
+			cs = append(cs, e.Node)
+		}
+	case *Prd:
+		for _, e := range n.Edges {
+			cs = append(cs, e.Node)
+		}
+	}
+	return cs
+}
+
+func appendOnce(ids []int, id int) []int {
+	if len(ids) > 0 && ids[len(ids)-1] == id {
+		return ids
+	}
+	return append(ids, id)
+}
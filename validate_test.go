@@ -0,0 +1,92 @@
+package maxspn
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSPN_Validate(t *testing.T) {
+	half := math.Log(0.5)
+	// Nodes 0-3 are the terminals of two binary variables.
+	base := func() []Node {
+		return []Node{
+			&Trm{Kth: 0, Value: 0, id: 0},
+			&Trm{Kth: 0, Value: 1, id: 1},
+			&Trm{Kth: 1, Value: 0, id: 2},
+			&Trm{Kth: 1, Value: 1, id: 3},
+		}
+	}
+	build := func(extra ...func(ns []Node) Node) SPN {
+		ns := base()
+		for _, f := range extra {
+			n := f(ns)
+			n.SetID(len(ns))
+			ns = append(ns, n)
+		}
+		return SPN{Nodes: ns, Schema: []int{2, 2}}
+	}
+	sum := func(ws []float64, cs ...int) func([]Node) Node {
+		return func(ns []Node) Node {
+			s := &Sum{}
+			for i, c := range cs {
+				s.Edges = append(s.Edges, SumEdge{ws[i], ns[c]})
+			}
+			return s
+		}
+	}
+	prd := func(cs ...int) func([]Node) Node {
+		return func(ns []Node) Node {
+			p := &Prd{}
+			for _, c := range cs {
+				p.Edges = append(p.Edges, PrdEdge{ns[c]})
+			}
+			return p
+		}
+	}
+	halves := []float64{half, half}
+	for _, test := range []struct {
+		name string
+		spn  SPN
+		want Report
+	}{
+		{"valid", build(sum(halves, 0, 1), sum(halves, 2, 3), prd(4, 5)),
+			Report{Roots: []int{6}}},
+		{"non-selective", build(sum(halves, 0, 1), sum(halves, 2, 3), prd(4, 5), prd(0, 2), sum(halves, 6, 7)),
+			Report{Roots: []int{8}, NonSelective: []int{8}}},
+		{"selective", build(prd(0, 2), prd(1, 3), sum(halves, 4, 5)),
+			Report{Roots: []int{6}}},
+		{"incomplete", build(sum(halves, 0, 2)),
+			Report{Roots: []int{1, 3, 4}, Incomplete: []int{4}, NonSelective: []int{4}}},
+		{"non-decomposable", build(prd(0, 1), sum([]float64{0}, 4)),
+			Report{Roots: []int{2, 3, 5}, NonDecomposable: []int{4}}},
+		{"unnormalized", build(sum([]float64{0, 0}, 0, 1), sum(halves, 2, 3), prd(4, 5)),
+			Report{Roots: []int{6}, Unnormalized: []int{4}}},
+		{"bad terminal", SPN{Nodes: []Node{&Trm{Kth: 0, Value: 2}}, Schema: []int{2}},
+			Report{Roots: []int{0}, BadTerminals: []int{0}}},
+	} {
+		got := test.spn.Validate()
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+
+	spn := build(sum(halves, 0, 1), sum(halves, 2, 3), prd(4, 5))
+	spn.Nodes[4], spn.Nodes[5] = spn.Nodes[5], spn.Nodes[4]
+	r := spn.Validate()
+	if r.Ordered() || r.Err() == nil || !strings.Contains(r.Err().Error(), "order") {
+		t.Errorf("swapped nodes: got %+v, error %v", r, r.Err())
+	}
+}
+
+func TestSPN_ValidateRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for times := 0; times < 10; times++ {
+		rep := randomSPN(r, []int{2, 3, 2, 4, 2}).Validate()
+		if err := rep.Err(); err != nil || !rep.Valid() {
+			t.Fatalf("random SPN: %v %+v", err, rep)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package maxspn
+
+import "context"
+
+// Workspace is an evaluator bound to one network that owns the buffers of
+// its passes: the node values and derivatives, and free lists of assignment
+// matrices and variable slices that a search takes at every node and gives
+// back when it leaves the node. Once the free lists have grown to the depth of
+// the search, its passes do not allocate. It is not safe for concurrent use;
+// every search goroutine uses its own.
+type Workspace struct {
+	spn    SPN
+	f      *Flat
+	dv     *Derivatives
+	mats   [][][]float64
+	ints   [][]int
+	intCap int
+}
+
+// NewWorkspace returns a workspace of spn, whose nodes must be in topological
+// order.
+func NewWorkspace(spn SPN) *Workspace {
+	w := &Workspace{spn: spn, f: spn.Flatten(), intCap: len(spn.Schema)}
+	w.dv = w.f.NewDerivatives()
+	for _, card := range spn.Schema {
+		if w.intCap < card {
+			w.intCap = card
+		}
+	}
+	return w
+}
+
+// SPN returns the network of w.
+func (w *Workspace) SPN() SPN {
+	return w.spn
+}
+
+// Eval returns the log-value of the root at the assignment as.
+func (w *Workspace) Eval(as [][]float64) float64 {
+	val := w.f.evalContext(context.Background(), as, w.dv.Value)
+	return val[len(val)-1]
+}
+
+// EvalX is Eval of the assignment x, in which x[i] == -1 leaves variable i
+// free.
+func (w *Workspace) EvalX(x []int) float64 {
+	as := w.assignment(x)
+	p := w.Eval(as)
+	w.release(as)
+	return p
+}
+
+// evalPrefix is eval: the log-value of x with the variables from xi on summed
+// out.
+func (w *Workspace) evalPrefix(x []int, xi int) float64 {
+	as := w.matrix()
+	for i, row := range as {
+		for j := range row {
+			row[j] = 0
+			if i >= xi || j == x[i] {
+				row[j] = 1
+			}
+		}
+	}
+	p := w.Eval(as)
+	w.release(as)
+	return p
+}
+
+// Derivative stores in d, shaped as the schema, the derivatives of the
+// network at as with respect to each state of each variable, by
+// Differentiate. It returns false, leaving d undefined, if ctx is done before
+// the passes end.
+func (w *Workspace) Derivative(ctx context.Context, as, d [][]float64) bool {
+	w.dv.State = d
+	return w.f.Differentiate(ctx, as, w.dv)
+}
+
+// matrix takes a matrix shaped as the schema, with undefined entries, from
+// the free list.
+func (w *Workspace) matrix() [][]float64 {
+	if n := len(w.mats); n > 0 {
+		m := w.mats[n-1]
+		w.mats = w.mats[:n-1]
+		return m
+	}
+	size := 0
+	for _, card := range w.f.Schema {
+		size += card
+	}
+	buf := make([]float64, size)
+	m := make([][]float64, len(w.f.Schema))
+	for i, card := range w.f.Schema {
+		m[i], buf = buf[:card:card], buf[card:]
+	}
+	return m
+}
+
+// release gives m back to the free list.
+func (w *Workspace) release(m [][]float64) {
+	w.mats = append(w.mats, m)
+}
+
+// assignment takes a matrix holding X2Ass(x).
+func (w *Workspace) assignment(x []int) [][]float64 {
+	as := w.matrix()
+	fillAssignment(as, x)
+	return as
+}
+
+// fillAssignment stores X2Ass(x) in the matrix as.
+func fillAssignment(as [][]float64, x []int) {
+	for i, row := range as {
+		for j := range row {
+			row[j] = 0
+			if x[i] == -1 || x[i] == j {
+				row[j] = 1
+			}
+		}
+	}
+}
+
+// free takes a matrix holding freeAssignment.
+func (w *Workspace) free() [][]float64 {
+	as := w.matrix()
+	for _, row := range as {
+		for j := range row {
+			row[j] = 1
+		}
+	}
+	return as
+}
+
+// vars takes a slice of one element per variable, with undefined elements,
+// from the free list. Its capacity also holds a value of every variable.
+func (w *Workspace) vars() []int {
+	if n := len(w.ints); n > 0 {
+		x := w.ints[n-1]
+		w.ints = w.ints[:n-1]
+		return x[:len(w.f.Schema)]
+	}
+	return make([]int, len(w.f.Schema), w.intCap)
+}
+
+// releaseVars gives x back to the free list.
+func (w *Workspace) releaseVars(x []int) {
+	w.ints = append(w.ints, x)
+}
+
+// copyMatrix copies the entries of the matrix src to dst of the same shape.
+func copyMatrix(dst, src [][]float64) {
+	for i := range dst {
+		copy(dst[i], src[i])
+	}
+}
+
+// sortValues sorts the values vs of a variable by their derivatives d,
+// largest first, keeping the order of equal ones. The lists are as short as
+// the domains, so insertion sort does.
+func sortValues(vs []int, d []float64) {
+	for i := 1; i < len(vs); i++ {
+		for j := i; j > 0 && d[vs[j-1]] < d[vs[j]]; j-- {
+			vs[j-1], vs[j] = vs[j], vs[j-1]
+		}
+	}
+}
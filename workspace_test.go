@@ -0,0 +1,176 @@
+package maxspn
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestWorkspace(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	schema := []int{2, 3, 2, 4, 2, 2, 3, 2}
+	ctx := context.Background()
+	for times := 0; times < 5; times++ {
+		spn := randomSPN(r, schema)
+		w := NewWorkspace(spn)
+		d := w.matrix()
+		for k := 0; k < 10; k++ {
+			x := make([]int, len(schema))
+			for i := range x {
+				x[i] = r.Intn(schema[i]+1) - 1
+			}
+			as := X2Ass(x, schema)
+			if got, want := w.EvalX(x), spn.EvalX(x); got != want {
+				t.Errorf("EvalX(%v) = %v, want %v", x, got, want)
+			}
+			w.Derivative(ctx, as, d)
+			f := spn.Flatten()
+			dv := f.NewDerivatives()
+			f.Differentiate(ctx, as, dv)
+			want := dv.State
+			for i := range d {
+				if !sameFloats(d[i], want[i]) {
+					t.Errorf("Derivative(%v)[%d] = %v, want %v", x, i, d[i], want[i])
+				}
+			}
+			for i := range x {
+				x[i] = r.Intn(schema[i])
+			}
+			xi := r.Intn(len(x) + 1)
+			prefix := append([]int(nil), x...)
+			for i := xi; i < len(prefix); i++ {
+				prefix[i] = -1
+			}
+			if got, want := w.evalPrefix(x, xi), spn.EvalX(prefix); got != want {
+				t.Errorf("evalPrefix(%v, %d) = %v, want %v", x, xi, got, want)
+			}
+		}
+	}
+}
+
+// TestWorkspace_Allocs checks that the searches do not allocate once their
+// workspace has warmed up and the incumbent is optimal.
+func TestWorkspace_Allocs(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	schema := []int{2, 3, 2, 4, 2, 2, 3, 2}
+	spn := randomSPN(r, schema)
+	ctx := context.Background()
+	opt := exactFC(ctx, spn, math.Inf(-1)).P
+	w := NewWorkspace(spn)
+	free := func() []int {
+		x := make([]int, len(schema))
+		for i := range x {
+			x[i] = -1
+		}
+		return x
+	}
+	as, d := w.free(), w.matrix()
+	if n := testing.AllocsPerRun(10, func() { w.Derivative(ctx, as, d) }); n != 0 {
+		t.Errorf("Derivative: %v allocations", n)
+	}
+	for _, c := range []struct {
+		name string
+		run  func(s *search)
+	}{
+		{"dfsMP", func(s *search) { s.dfsMP(w, make([]int, len(schema)), 0, s.upper) }},
+		{"dfsFC", func(s *search) { s.dfsFC(w, free(), s.upper) }},
+		{"dfsORDERING", func(s *search) { s.dfsORDERING(w, free(), s.upper) }},
+		{"searchMax", func(s *search) {
+			as, d := w.free(), w.matrix()
+			s.forwardChecking(w, as, d)
+			s.searchMax(w, as, d, s.upper)
+			w.release(d)
+			w.release(as)
+		}},
+	} {
+		// The baseline is the optimum itself, so that no leaf improves on it.
+		s := newSearch(ctx, w, w.free(), opt)
+		c.run(s)
+		if s.stats.Expanded < 2 {
+			t.Fatalf("%s expanded %d nodes", c.name, s.stats.Expanded)
+		}
+		// The initial assignments are the only allocations.
+		if n := testing.AllocsPerRun(10, func() { c.run(s) }); n > 1 {
+			t.Errorf("%s: %v allocations per search", c.name, n)
+		}
+	}
+
+	// The searches without a search state return only a value, so they can
+	// run from no baseline without allocating at the leaves.
+	x, low := make([]int, len(schema)), math.Inf(-1)
+	for _, c := range []struct {
+		name string
+		run  func()
+	}{
+		{"dfs", func() { dfs(ctx, w, x, 0, low) }},
+		{"dfs2", func() { dfs2(ctx, w, free(), low) }},
+		{"dfs2Der", func() { dfs2Der(ctx, w, free(), low) }},
+		{"searchMaxBin", func() {
+			as, d := w.free(), w.matrix()
+			forwardCheckingBin(ctx, w, low, as, d)
+			searchMaxBin(ctx, w, low, as, d)
+			w.release(d)
+			w.release(as)
+		}},
+		{"dfsStage", func() { dfsStage(ctx, w, free(), low) }},
+		{"dfsFastStage", func() { dfsFastStage(ctx, w, free(), low, 0) }},
+	} {
+		c.run()
+		if n := testing.AllocsPerRun(10, c.run); n > 1 {
+			t.Errorf("%s: %v allocations per search", c.name, n)
+		}
+	}
+}
+
+func TestWorkspace_StageAllocs(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	schema := []int{2, 3, 2, 4, 2, 2, 3, 2, 2, 3, 2}
+	spn := randomSPN(r, schema)
+	ctx := context.Background()
+	low := math.Inf(-1)
+	w := NewWorkspace(spn)
+	free := func(n int) []int {
+		x := make([]int, n)
+		for i := range x {
+			x[i] = -1
+		}
+		return x
+	}
+
+	// Eight fixed variables stage dfsStage once, into a network of the other
+	// three, so that it allocates as a search on a new workspace of it does.
+	x := []int{0, 1, 0, 2, 1, 0, 2, 1, -1, -1, -1}
+	staged := spn.StageSPN(x)
+	dfsStage(ctx, w, x, low)
+	n := testing.AllocsPerRun(10, func() { dfsStage(ctx, w, x, low) })
+	build := testing.AllocsPerRun(10, func() { NewWorkspace(spn.StageSPN(x)) })
+	want := testing.AllocsPerRun(10, func() {
+		dfsStage(ctx, NewWorkspace(spn.StageSPN(x)), free(len(staged.Schema)), low)
+	})
+	if n < build || n > want {
+		t.Errorf("dfsStage: %v allocations per search, want between %v and %v", n, build, want)
+	}
+
+	// Five fixed variables stage the search of exactSTAGE once; the stage also
+	// copies the original variables and their values.
+	x = []int{0, 1, 0, 2, 1, -1, -1, -1, -1, -1, -1}
+	vars, full := make([]int, len(x)), make([]int, len(x))
+	for i := range vars {
+		vars[i] = i
+	}
+	s := newSearch(ctx, w, w.free(), low)
+	s.stage(w, x, vars, full, s.upper)
+	n = testing.AllocsPerRun(10, func() { s.stage(w, x, vars, full, s.upper) })
+	build = testing.AllocsPerRun(10, func() {
+		staged, _ := reduce(ctx, spn.StageSPN(x))
+		NewWorkspace(staged)
+	})
+	want = testing.AllocsPerRun(10, func() {
+		staged, _ := reduce(ctx, spn.StageSPN(x))
+		s.stage(NewWorkspace(staged), free(len(staged.Schema)), vars[5:], full, s.upper)
+	})
+	if n < build || n > want+2 {
+		t.Errorf("stage: %v allocations per search, want between %v and %v", n, build, want+2)
+	}
+}